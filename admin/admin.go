@@ -0,0 +1,273 @@
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/transport"
+)
+
+// Socket used when -admin / -socket is not given
+const DEFAULT_SOCKET = "/var/run/go-vpn.sock"
+
+const CMD_STATUS = "status"
+const CMD_DISCONNECT = "disconnect"
+const CMD_RECONNECT = "reconnect"
+const CMD_ADD_ROUTE = "add-route"
+const CMD_DEL_ROUTE = "del-route"
+const CMD_RELOAD = "reload"
+const CMD_CAPTURE = "capture"
+
+// Arguments of CMD_CAPTURE
+const CAPTURE_START = "start"
+const CAPTURE_STOP = "stop"
+const CAPTURE_STREAM = "stream"
+
+// Controller is what the running go-vpn exposes on the admin socket
+type Controller interface {
+	Status() Status
+	// Disconnect drops the session and stops reconnecting until Reconnect
+	Disconnect() error
+	// Reconnect drops the session (if any) and connects again
+	Reconnect() error
+	AddRoute(cidr string) error
+	DelRoute(cidr string) error
+	// Reload re-reads the configuration files (e.g. the filter rules)
+	Reload() error
+	// StartCapture writes the packets matching filter to a pcapng file at path
+	StartCapture(path string, filter string) error
+	StopCapture() error
+	// StreamCapture writes the packets matching filter in the pcapng format to out until done is closed
+	StreamCapture(out io.Writer, filter string, done <-chan struct{}) error
+}
+
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+type Response struct {
+	OK      bool    `json:"ok"`
+	Error   string  `json:"error,omitempty"`
+	Message string  `json:"message,omitempty"`
+	Status  *Status `json:"status,omitempty"`
+}
+
+type Status struct {
+	Mode         string    `json:"mode"`
+	Device       string    `json:"device"`
+	LocalAddress string    `json:"local_address"`
+	Uptime       string    `json:"uptime"`
+	Paused       bool      `json:"paused"`
+	Capture      string    `json:"capture,omitempty"`
+	Sessions     []Session `json:"sessions"`
+	Stats        Counters  `json:"stats"`
+}
+
+type Session struct {
+	Peer            string              `json:"peer"`
+	Profile         string              `json:"profile,omitempty"`
+	RemoteAddress   string              `json:"remote_address"`
+	Uptime          string              `json:"uptime"`
+	MTU             int                 `json:"mtu"`
+	RoutesRequested []string            `json:"routes_requested"`
+	RoutesInstalled []string            `json:"routes_installed"`
+	Transport       transport.PoolStats `json:"transport"`
+}
+
+type Counters struct {
+	SentBytes       uint64            `json:"sent_bytes"`
+	ReceivedBytes   uint64            `json:"received_bytes"`
+	SentPackets     uint64            `json:"sent_packets"`
+	ReceivedPackets uint64            `json:"received_packets"`
+	Dropped         map[string]uint64 `json:"dropped"`
+	Errors          map[string]uint64 `json:"errors"`
+	Reconnects      uint64            `json:"reconnects"`
+	RTT             string            `json:"rtt"`
+	Jitter          string            `json:"jitter"`
+	EchoSent        uint64            `json:"echo_sent"`
+	EchoLost        uint64            `json:"echo_lost"`
+	// Wait before the next reconnect and the failures in a row that led to it
+	Backoff        string `json:"backoff"`
+	FailedAttempts uint64 `json:"failed_attempts"`
+}
+
+// Serve answers admin requests on the unix socket at path until the listener is closed.
+// A stale socket file is replaced, the new one is only accessible by the owner
+func Serve(path string, controller Controller) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// the socket is created with the permissions left by the umask, it must never be accessible by others
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	logging.For(logging.MAIN).Info("Admin socket listening", "path", path)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn, controller)
+		}
+	}()
+	return listener, nil
+}
+
+// handle serves one JSON request per line until the client disconnects
+func handle(conn net.Conn, controller Controller) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var request Request
+		var response Response
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			response = Response{Error: fmt.Sprintf("invalid request: %s", err)}
+		} else if request.Command == CMD_CAPTURE && len(request.Args) > 0 && request.Args[0] == CAPTURE_STREAM {
+			// the connection carries the capture from now on
+			stream(conn, encoder, request, controller)
+			return
+		} else {
+			response = dispatch(request, controller)
+		}
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+func dispatch(request Request, controller Controller) Response {
+	var err error
+	var message string
+	switch request.Command {
+	case CMD_STATUS:
+		status := controller.Status()
+		return Response{OK: true, Status: &status}
+	case CMD_DISCONNECT:
+		err = controller.Disconnect()
+		message = "disconnected"
+	case CMD_RECONNECT:
+		err = controller.Reconnect()
+		message = "reconnecting"
+	case CMD_ADD_ROUTE, CMD_DEL_ROUTE:
+		if len(request.Args) != 1 {
+			return Response{Error: fmt.Sprintf("%s requires one cidr", request.Command)}
+		}
+		if request.Command == CMD_ADD_ROUTE {
+			err = controller.AddRoute(request.Args[0])
+			message = fmt.Sprintf("route %s added", request.Args[0])
+		} else {
+			err = controller.DelRoute(request.Args[0])
+			message = fmt.Sprintf("route %s deleted", request.Args[0])
+		}
+	case CMD_RELOAD:
+		err = controller.Reload()
+		message = "reloaded"
+	case CMD_CAPTURE:
+		if len(request.Args) == 1 && request.Args[0] == CAPTURE_STOP {
+			err = controller.StopCapture()
+			message = "capture stopped"
+		} else if len(request.Args) >= 2 && request.Args[0] == CAPTURE_START {
+			err = controller.StartCapture(request.Args[1], strings.Join(request.Args[2:], " "))
+			message = fmt.Sprintf("capturing to %s", request.Args[1])
+		} else {
+			return Response{Error: "capture requires start <file> [filter], stop or stream [filter]"}
+		}
+	default:
+		return Response{Error: fmt.Sprintf("unknown command %s", request.Command)}
+	}
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	return Response{OK: true, Message: message}
+}
+
+// stream_writer sends the OK response before the first bytes of the stream
+type stream_writer struct {
+	out     io.Writer
+	encoder *json.Encoder
+	started bool
+}
+
+func (v *stream_writer) Write(data []byte) (int, error) {
+	if !v.started {
+		v.started = true
+		if err := v.encoder.Encode(Response{OK: true, Message: "streaming"}); err != nil {
+			return 0, err
+		}
+	}
+	return v.out.Write(data)
+}
+
+// stream serves a capture stream until the client closes the connection
+func stream(conn net.Conn, encoder *json.Encoder, request Request, controller Controller) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(done)
+	}()
+	out := &stream_writer{out: conn, encoder: encoder}
+	err := controller.StreamCapture(out, strings.Join(request.Args[1:], " "), done)
+	if err != nil && !out.started {
+		encoder.Encode(Response{Error: err.Error()})
+	}
+}
+
+// Call sends one request to the admin socket at path and waits for the response
+func Call(path string, request Request) (Response, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return Response{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return Response{}, err
+	}
+	var response Response
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return Response{}, err
+	}
+	return response, nil
+}
+
+// Stream sends a request answered by a stream, e.g. capture stream, and copies the stream to out
+// until either side closes the connection
+func Stream(path string, request Request, out io.Writer) error {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var response Response
+	if err := json.Unmarshal(line, &response); err != nil {
+		return err
+	}
+	if !response.OK {
+		return errors.New(response.Error)
+	}
+	_, err = io.Copy(out, reader)
+	return err
+}
@@ -0,0 +1,73 @@
+package backoff
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const DEFAULT_INITIAL = 1 * time.Second
+const DEFAULT_MAX = 60 * time.Second
+const DEFAULT_MULTIPLIER = 2.0
+const DEFAULT_JITTER = 0.2
+const DEFAULT_RESET = 30 * time.Second
+
+// Backoff computes the delays between retries: Initial, growing by Multiplier on every failure in a row
+// up to Max. Each delay is randomized by +/- Jitter (a fraction of it) so many clients don't retry in sync
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+	// A session healthy for this long resets the backoff
+	ResetAfter time.Duration
+
+	attempts int
+	current  time.Duration
+}
+
+func New() *Backoff {
+	return &Backoff{
+		Initial:    DEFAULT_INITIAL,
+		Max:        DEFAULT_MAX,
+		Multiplier: DEFAULT_MULTIPLIER,
+		Jitter:     DEFAULT_JITTER,
+		ResetAfter: DEFAULT_RESET,
+	}
+}
+
+// Next records a failure and returns how long to wait before the next attempt
+func (v *Backoff) Next() time.Duration {
+	if v.attempts == 0 {
+		v.current = v.Initial
+	} else {
+		v.current = time.Duration(float64(v.current) * v.Multiplier)
+	}
+	if v.current > v.Max {
+		v.current = v.Max
+	}
+	v.attempts++
+	delay := v.current
+	if v.Jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + v.Jitter*(2*rand.Float64()-1)))
+	}
+	return min(delay, v.Max)
+}
+
+// Healthy resets the backoff when the session lasted at least ResetAfter. Returns true if it did
+func (v *Backoff) Healthy(uptime time.Duration) bool {
+	if uptime < v.ResetAfter {
+		return false
+	}
+	v.Reset()
+	return true
+}
+
+func (v *Backoff) Reset() {
+	v.attempts = 0
+	v.current = 0
+}
+
+// Attempts is the number of failures in a row
+func (v *Backoff) Attempts() int {
+	return v.attempts
+}
@@ -1,34 +1,119 @@
 package common
 
 import (
-	"log"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+
+	"github.com/wushilin/go-vpn/logging"
 )
 
+var logger = logging.For(logging.ROUTES)
+
+const IP_COMMAND = "/usr/sbin/ip"
+
+// Routing table of the routes installed by go-vpn, empty is the main table
+var RouteTable = ""
+
+// Metric of the routes installed by go-vpn, 0 is the kernel default
+var RouteMetric = 0
+
+// route_options places a route in RouteTable with RouteMetric
+func route_options(args ...string) []string {
+	if RouteTable != "" {
+		args = append(args, "table", RouteTable)
+	}
+	if RouteMetric != 0 {
+		args = append(args, "metric", strconv.Itoa(RouteMetric))
+	}
+	return args
+}
+
+// table_option selects RouteTable in the commands that don't take a metric
+func table_option(args ...string) []string {
+	if RouteTable != "" {
+		args = append(args, "table", RouteTable)
+	}
+	return args
+}
+
 func cmd(args ...string) error {
-	ipcmd := "/usr/sbin/ip"
-	log.Println(ipcmd, strings.Join(args, " "))
+	ipcmd := IP_COMMAND
+	logger.Info("Running", "command", ipcmd+" "+strings.Join(args, " "))
 	cmd := exec.Command(ipcmd, args...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 
 	if err := cmd.Run(); err != nil {
-		log.Printf("Failed to run: %v\n", err)
+		logger.Error("Failed to run", "command", ipcmd+" "+strings.Join(args, " "), "error", err)
 		return err
 	}
 	return nil
 }
 
 func AddRoute(device, next string) bool {
-	return cmd("route", "add", next, "dev", device) == nil
+	return cmd(route_options("route", "add", next, "dev", device)...) == nil
+}
+
+// ReplaceRoute sends next to device, taking over an identical route of another device
+func ReplaceRoute(device, next string) bool {
+	return cmd(route_options("route", "replace", next, "dev", device)...) == nil
+}
+
+func DelRoute(device, next string) bool {
+	return cmd(route_options("route", "del", next, "dev", device)...) == nil
 }
 
 func BringUpLink(device string) bool {
 	return cmd("link", "set", "dev", device, "up") == nil
 }
 
+func SetMTU(device string, mtu int) bool {
+	return cmd("link", "set", "dev", device, "mtu", strconv.Itoa(mtu)) == nil
+}
+
 func SetIPAddress(device, laddr string) bool {
 	return cmd("addr", "add", laddr, "dev", device) == nil
 }
+
+func DelIPAddress(device, laddr string) bool {
+	return cmd("addr", "del", laddr, "dev", device) == nil
+}
+
+// RouteTo returns the gateway (empty when on link) and the device the kernel uses to reach address
+func RouteTo(address string) (gateway string, device string, ok bool) {
+	output, err := exec.Command(IP_COMMAND, "route", "get", address).Output()
+	if err != nil {
+		logger.Error("Failed to run", "command", IP_COMMAND+" route get "+address, "error", err)
+		return "", "", false
+	}
+	tokens := strings.Fields(string(output))
+	for i := 0; i+1 < len(tokens); i++ {
+		switch tokens[i] {
+		case "via":
+			gateway = tokens[i+1]
+		case "dev":
+			device = tokens[i+1]
+		}
+	}
+	return gateway, device, device != ""
+}
+
+// AddHostRoute routes address through gateway on device, outside the tunnel. An empty gateway means on link
+func AddHostRoute(address, gateway, device string) bool {
+	if gateway == "" {
+		return cmd(route_options("route", "add", address, "dev", device)...) == nil
+	}
+	return cmd(route_options("route", "add", address, "via", gateway, "dev", device)...) == nil
+}
+
+// HasHostRoute is true when RouteTable has a route for address alone
+func HasHostRoute(address string) bool {
+	output, err := exec.Command(IP_COMMAND, table_option("route", "show", "exact", address)...).Output()
+	return err == nil && strings.TrimSpace(string(output)) != ""
+}
+
+func DelHostRoute(address string) bool {
+	return cmd(route_options("route", "del", address)...) == nil
+}
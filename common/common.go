@@ -14,3 +14,16 @@ func ToArray(input string) []string {
 	}
 	return result
 }
+
+// ToList splits a comma separated flag value, skipping empty items
+func ToList(input string) []string {
+	result := make([]string, 0)
+	for _, next := range strings.Split(input, ",") {
+		next = strings.TrimSpace(next)
+		if next == "" {
+			continue
+		}
+		result = append(result, next)
+	}
+	return result
+}
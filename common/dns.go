@@ -0,0 +1,157 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// How the DNS settings pushed by the server are applied
+const DNS_AUTO = "auto"
+const DNS_RESOLVED = "resolved"
+const DNS_RESOLVCONF = "resolvconf"
+const DNS_OFF = "off"
+
+const RESOLV_CONF = "/etc/resolv.conf"
+
+// Upstream servers of systemd-resolved, when resolv.conf points to its local stub
+const RESOLVED_CONF = "/run/systemd/resolve/resolv.conf"
+
+// Copy of resolv.conf while it is replaced. Left behind when the process is killed, the next SetDNS restores from it
+const RESOLV_CONF_BACKUP = RESOLV_CONF + ".go-vpn"
+
+// SetDNS sends the name resolution to servers, with the search domains, and returns the function reverting it.
+// DNS_RESOLVED configures systemd-resolved for device only, DNS_RESOLVCONF replaces resolv.conf and
+// DNS_AUTO picks systemd-resolved when it is running
+func SetDNS(mode string, device string, servers []string, search []string) (func(), error) {
+	if mode == DNS_AUTO {
+		mode = DNS_RESOLVCONF
+		if resolved_running() {
+			mode = DNS_RESOLVED
+		}
+	}
+	switch mode {
+	case DNS_RESOLVED:
+		return set_resolved(device, servers, search)
+	case DNS_RESOLVCONF:
+		return set_resolv_conf(servers, search)
+	case DNS_OFF:
+		return func() {}, nil
+	}
+	return nil, fmt.Errorf("invalid dns mode %s", mode)
+}
+
+func resolved_running() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+	_, err := os.Stat("/run/systemd/resolve")
+	return err == nil
+}
+
+func resolvectl(args ...string) error {
+	logger.Info("Running", "command", "resolvectl "+strings.Join(args, " "))
+	output, err := exec.Command("resolvectl", args...).CombinedOutput()
+	if err != nil {
+		logger.Error("Failed to run", "command", "resolvectl "+strings.Join(args, " "), "error", err, "output", string(output))
+	}
+	return err
+}
+
+func set_resolved(device string, servers []string, search []string) (func(), error) {
+	revert := func() {
+		resolvectl("revert", device)
+	}
+	if err := resolvectl(append([]string{"dns", device}, servers...)...); err != nil {
+		return nil, err
+	}
+	// without search domains the tunnel resolves all names
+	domains := search
+	if len(domains) == 0 {
+		domains = []string{"~."}
+	}
+	if err := resolvectl(append([]string{"domain", device}, domains...)...); err != nil {
+		revert()
+		return nil, err
+	}
+	return revert, nil
+}
+
+func set_resolv_conf(servers []string, search []string) (func(), error) {
+	original, err := os.ReadFile(RESOLV_CONF_BACKUP)
+	if errors.Is(err, os.ErrNotExist) {
+		original, err = os.ReadFile(RESOLV_CONF)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err := os.WriteFile(RESOLV_CONF_BACKUP, original, 0644); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		logger.Warn("Restoring resolv.conf left behind", "backup", RESOLV_CONF_BACKUP)
+	}
+	var content strings.Builder
+	content.WriteString("# written by go-vpn, restored when the session ends\n")
+	for _, server := range servers {
+		fmt.Fprintf(&content, "nameserver %s\n", server)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&content, "search %s\n", strings.Join(search, " "))
+	}
+	// keep the options of the system
+	for _, line := range strings.Split(string(original), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "options") {
+			content.WriteString(line + "\n")
+		}
+	}
+	logger.Info("Replacing resolv.conf", "servers", servers, "search", search)
+	if err := os.WriteFile(RESOLV_CONF, []byte(content.String()), 0644); err != nil {
+		return nil, err
+	}
+	return func() {
+		logger.Info("Restoring resolv.conf")
+		if err := os.WriteFile(RESOLV_CONF, original, 0644); err != nil {
+			logger.Error("Unable to restore resolv.conf", "error", err, "backup", RESOLV_CONF_BACKUP)
+			return
+		}
+		os.Remove(RESOLV_CONF_BACKUP)
+	}, nil
+}
+
+// HostResolvers lists the name servers of the host, outside of the loopback: the ones of resolv.conf (of its
+// backup while go-vpn replaced it) and the upstream servers of systemd-resolved
+func HostResolvers() []netip.Addr {
+	var result []netip.Addr
+	files := []string{RESOLV_CONF_BACKUP, RESOLVED_CONF}
+	if _, err := os.Stat(RESOLV_CONF_BACKUP); err != nil {
+		files[0] = RESOLV_CONF
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != "nameserver" {
+				continue
+			}
+			// a scoped IPv6 server, fe80::1%eth0, is matched without its zone
+			address, err := netip.ParseAddr(fields[1])
+			if err != nil || address.IsLoopback() {
+				continue
+			}
+			address = address.WithZone("").Unmap()
+			if !slices.Contains(result, address) {
+				result = append(result, address)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+package common
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const NFT_COMMAND = "/usr/sbin/nft"
+
+// nftables table of the kill switch. Left behind when the process is killed, traffic stays blocked until
+// the next run or `nft delete table inet go_vpn`
+const KILL_SWITCH_TABLE = "go_vpn"
+
+// HasNft fails when nftables can't be managed on this host
+func HasNft() error {
+	if _, err := os.Stat(NFT_COMMAND); err != nil {
+		return fmt.Errorf("requires %s", NFT_COMMAND)
+	}
+	return nil
+}
+
+func nft(script string) error {
+	logger.Debug("Running", "command", NFT_COMMAND+" -f -", "script", script)
+	command := exec.Command(NFT_COMMAND, "-f", "-")
+	command.Stdin = strings.NewReader(script)
+	output, err := command.CombinedOutput()
+	if err != nil {
+		logger.Error("Failed to run", "command", NFT_COMMAND+" -f -", "error", err, "output", string(output))
+		return fmt.Errorf("%s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// EnableKillSwitch drops the outgoing traffic except through device, to the servers and the loopback.
+// DNS queries (port 53) to resolvers stay allowed, for servers given by name. Replaces the rules of a previous call
+func EnableKillSwitch(device string, servers []netip.Addr, resolvers []netip.Addr) error {
+	v4, v6 := split_families(servers)
+	dns4, dns6 := split_families(resolvers)
+	var script strings.Builder
+	// creating the table first makes the delete succeed on the first run, both apply atomically
+	fmt.Fprintf(&script, "table inet %s\n", KILL_SWITCH_TABLE)
+	fmt.Fprintf(&script, "delete table inet %s\n", KILL_SWITCH_TABLE)
+	fmt.Fprintf(&script, "table inet %s {\n", KILL_SWITCH_TABLE)
+	script.WriteString("\tchain output {\n")
+	script.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	script.WriteString("\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&script, "\t\toifname %q accept\n", device)
+	if len(v4) > 0 {
+		fmt.Fprintf(&script, "\t\tip daddr { %s } accept\n", strings.Join(v4, ", "))
+	}
+	if len(v6) > 0 {
+		fmt.Fprintf(&script, "\t\tip6 daddr { %s } accept\n", strings.Join(v6, ", "))
+	}
+	if len(dns4) > 0 {
+		fmt.Fprintf(&script, "\t\tip daddr { %s } meta l4proto { tcp, udp } th dport 53 accept\n", strings.Join(dns4, ", "))
+	}
+	if len(dns6) > 0 {
+		fmt.Fprintf(&script, "\t\tip6 daddr { %s } meta l4proto { tcp, udp } th dport 53 accept\n", strings.Join(dns6, ", "))
+	}
+	// keep the lease and the neighbours of the physical interfaces
+	script.WriteString("\t\tudp sport 68 udp dport 67 accept\n")
+	script.WriteString("\t\ticmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-solicit } accept\n")
+	script.WriteString("\t}\n}\n")
+	return nft(script.String())
+}
+
+// split_families writes the IPv4 and the IPv6 addresses for nftables
+func split_families(addresses []netip.Addr) (v4 []string, v6 []string) {
+	for _, address := range addresses {
+		if address.Unmap().Is4() {
+			v4 = append(v4, address.Unmap().String())
+		} else {
+			v6 = append(v6, address.String())
+		}
+	}
+	return v4, v6
+}
+
+// DisableKillSwitch removes the rules of EnableKillSwitch
+func DisableKillSwitch() error {
+	return nft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", KILL_SWITCH_TABLE, KILL_SWITCH_TABLE))
+}
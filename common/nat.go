@@ -0,0 +1,41 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// nftables table of the masquerading, replaced on the next run when left behind
+const MASQUERADE_TABLE = "go_vpn_nat"
+
+const IP_FORWARD = "/proc/sys/net/ipv4/ip_forward"
+
+// EnableMasquerade rewrites the source of the packets coming out of device and leaving through one of
+// interfaces to the address of that interface, so the hosts behind it need no route back to the tunnel
+func EnableMasquerade(device string, interfaces []string) error {
+	quoted := make([]string, len(interfaces))
+	for i, next := range interfaces {
+		quoted[i] = fmt.Sprintf("%q", next)
+	}
+	var script strings.Builder
+	fmt.Fprintf(&script, "table inet %s\n", MASQUERADE_TABLE)
+	fmt.Fprintf(&script, "delete table inet %s\n", MASQUERADE_TABLE)
+	fmt.Fprintf(&script, "table inet %s {\n", MASQUERADE_TABLE)
+	script.WriteString("\tchain postrouting {\n")
+	script.WriteString("\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	fmt.Fprintf(&script, "\t\tiifname %q oifname { %s } masquerade\n", device, strings.Join(quoted, ", "))
+	script.WriteString("\t}\n}\n")
+	if err := nft(script.String()); err != nil {
+		return err
+	}
+	if forward, err := os.ReadFile(IP_FORWARD); err == nil && strings.TrimSpace(string(forward)) != "1" {
+		logger.Warn("IP forwarding is disabled, the tunnel can't reach the LAN. Enable it with `sysctl net.ipv4.ip_forward=1`")
+	}
+	return nil
+}
+
+// DisableMasquerade removes the rules of EnableMasquerade
+func DisableMasquerade() error {
+	return nft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", MASQUERADE_TABLE, MASQUERADE_TABLE))
+}
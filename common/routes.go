@@ -0,0 +1,136 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strconv"
+)
+
+// KernelRoute is a route of a kernel routing table
+type KernelRoute struct {
+	Prefix netip.Prefix
+	Device string
+	// Network of an address of Device, added by the kernel
+	Connected bool
+	// What RestoreRoute needs to add the route again, empty when the route doesn't have it
+	Gateway  string
+	Protocol string
+	Scope    string
+	Source   string
+	Metric   int
+}
+
+func (v KernelRoute) String() string {
+	return fmt.Sprintf("%s dev %s", v.Prefix, v.Device)
+}
+
+// ShowRoutes lists the routes of table (empty is main) of one family, ipv6 or not. A table without
+// routes may not exist, it is empty
+func ShowRoutes(table string, ipv6 bool) ([]KernelRoute, error) {
+	if table == "" {
+		table = "main"
+	}
+	family := "-4"
+	if ipv6 {
+		family = "-6"
+	}
+	output, err := exec.Command(IP_COMMAND, "-j", family, "route", "show", "table", table).Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok && table != "main" {
+			logger.Debug("Routing table not readable, assuming empty", "table", table, "error", string(exit.Stderr))
+			return nil, nil
+		}
+		return nil, err
+	}
+	var routes []struct {
+		Dst      string `json:"dst"`
+		Gateway  string `json:"gateway"`
+		Dev      string `json:"dev"`
+		Protocol string `json:"protocol"`
+		Scope    string `json:"scope"`
+		Prefsrc  string `json:"prefsrc"`
+		Metric   int    `json:"metric"`
+		Type     string `json:"type"`
+	}
+	if err := json.Unmarshal(output, &routes); err != nil {
+		return nil, err
+	}
+	var result []KernelRoute
+	for _, route := range routes {
+		// unreachable, blackhole and the like carry no device
+		if route.Type != "" && route.Type != "unicast" {
+			continue
+		}
+		prefix, err := parse_dst(route.Dst, ipv6)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, KernelRoute{
+			Prefix:    prefix,
+			Device:    route.Dev,
+			Connected: route.Protocol == "kernel",
+			Gateway:   route.Gateway,
+			Protocol:  route.Protocol,
+			Scope:     route.Scope,
+			Source:    route.Prefsrc,
+			Metric:    route.Metric,
+		})
+	}
+	return result, nil
+}
+
+// parse_dst reads the destination of `ip route`: default, an address or a prefix
+func parse_dst(dst string, ipv6 bool) (netip.Prefix, error) {
+	if dst == "default" {
+		if ipv6 {
+			return netip.MustParsePrefix("::/0"), nil
+		}
+		return netip.MustParsePrefix("0.0.0.0/0"), nil
+	}
+	if prefix, err := netip.ParsePrefix(dst); err == nil {
+		return prefix, nil
+	}
+	addr, err := netip.ParseAddr(dst)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("unexpected route destination %s", dst)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// RestoreRoute adds a route listed by ShowRoutes back to RouteTable, like it was before go-vpn replaced it
+func RestoreRoute(route KernelRoute) bool {
+	args := []string{"route", "add", route.Prefix.String()}
+	if route.Gateway != "" {
+		args = append(args, "via", route.Gateway)
+	}
+	args = append(args, "dev", route.Device)
+	if route.Protocol != "" {
+		args = append(args, "proto", route.Protocol)
+	}
+	if route.Scope != "" {
+		args = append(args, "scope", route.Scope)
+	}
+	if route.Source != "" {
+		args = append(args, "src", route.Source)
+	}
+	if route.Metric != 0 {
+		args = append(args, "metric", strconv.Itoa(route.Metric))
+	}
+	return cmd(table_option(args...)...) == nil
+}
+
+// HasRoute tells whether RouteTable still has route, on the same device
+func HasRoute(route KernelRoute) (bool, error) {
+	routes, err := ShowRoutes(RouteTable, route.Prefix.Addr().Is6())
+	if err != nil {
+		return false, err
+	}
+	for _, next := range routes {
+		if next.Prefix.Masked() == route.Prefix.Masked() && next.Device == route.Device {
+			return true, nil
+		}
+	}
+	return false, nil
+}
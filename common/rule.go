@@ -0,0 +1,75 @@
+package common
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ParseRule checks an ip rule selector sending packets to RouteTable: `from <prefix>`, `fwmark <mark>`
+// or `not fwmark <mark>`
+func ParseRule(selector string) error {
+	tokens := strings.Fields(selector)
+	if len(tokens) == 3 && tokens[0] == "not" {
+		tokens = tokens[1:]
+	}
+	if len(tokens) != 2 {
+		return fmt.Errorf("invalid rule %q, expect from <prefix>, fwmark <mark> or not fwmark <mark>", selector)
+	}
+	switch tokens[0] {
+	case "from":
+		if _, err := netip.ParsePrefix(tokens[1]); err != nil {
+			if _, err := netip.ParseAddr(tokens[1]); err != nil {
+				return fmt.Errorf("invalid prefix %s in rule %q", tokens[1], selector)
+			}
+		}
+	case "fwmark":
+		if _, err := ParseMark(tokens[1]); err != nil {
+			return fmt.Errorf("invalid mark %s in rule %q", tokens[1], selector)
+		}
+	default:
+		return fmt.Errorf("invalid rule %q, expect from <prefix>, fwmark <mark> or not fwmark <mark>", selector)
+	}
+	return nil
+}
+
+// ParseMark reads a firewall mark, decimal or 0x hexadecimal
+func ParseMark(value string) (int, error) {
+	mark, err := strconv.ParseUint(value, 0, 32)
+	return int(mark), err
+}
+
+// rule_families are the address families of selector, fwmark rules apply to both
+func rule_families(selector string) []string {
+	if strings.Contains(selector, "from") {
+		return []string{""}
+	}
+	return []string{"-4", "-6"}
+}
+
+func rule(action string, selector string) bool {
+	ok := true
+	for _, family := range rule_families(selector) {
+		args := []string{"rule", action}
+		if family != "" {
+			args = append([]string{family}, args...)
+		}
+		args = append(args, strings.Fields(selector)...)
+		args = append(args, "lookup", RouteTable)
+		if err := cmd(args...); err != nil && family != "-6" {
+			// IPv6 may be disabled on the host
+			ok = false
+		}
+	}
+	return ok
+}
+
+// AddRule looks up RouteTable for the packets matching selector, see ParseRule
+func AddRule(selector string) bool {
+	return rule("add", selector)
+}
+
+func DelRule(selector string) bool {
+	return rule("del", selector)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/wushilin/go-vpn/admin"
+	"github.com/wushilin/go-vpn/piper"
+	"github.com/wushilin/go-vpn/profile"
+	"github.com/wushilin/go-vpn/stats"
+	"github.com/wushilin/go-vpn/transport"
+)
+
+// State of the running session, shared between the service loop, the metrics endpoint and the admin socket
+var active_mutex sync.Mutex
+var active_pipes []*piper.Pipe
+var active_filter *piper.Filter
+var active_profiles *profile.Profiles
+var session_cancels = make(map[string]context.CancelCauseFunc)
+var paused bool
+var resume = make(chan struct{}, 1)
+var process_started = time.Now()
+
+// Packet capture of all sessions, controlled by the -capture flags and the admin socket
+var capture = piper.NewCapture()
+
+func add_active_pipe(p *piper.Pipe) {
+	active_mutex.Lock()
+	defer active_mutex.Unlock()
+	active_pipes = append(active_pipes, p)
+}
+
+func remove_active_pipe(p *piper.Pipe) {
+	active_mutex.Lock()
+	defer active_mutex.Unlock()
+	active_pipes = slices.DeleteFunc(active_pipes, func(next *piper.Pipe) bool {
+		return next == p
+	})
+}
+
+func get_active_pipes() []*piper.Pipe {
+	active_mutex.Lock()
+	defer active_mutex.Unlock()
+	return slices.Clone(active_pipes)
+}
+
+// get_active_pipe returns the running session, the admin socket changes its routes
+func get_active_pipe() (*piper.Pipe, error) {
+	pipes := get_active_pipes()
+	switch len(pipes) {
+	case 0:
+		return nil, errors.New("not connected")
+	case 1:
+		return pipes[0], nil
+	default:
+		return nil, fmt.Errorf("%d sessions running, routes are changed per session only with one", len(pipes))
+	}
+}
+
+// get_active_transports returns the transports of the running sessions, for the metrics
+func get_active_transports() []transport.Transport {
+	var result []transport.Transport
+	for _, pipe := range get_active_pipes() {
+		result = append(result, pipe.Transport)
+	}
+	return result
+}
+
+func get_active_profiles() *profile.Profiles {
+	active_mutex.Lock()
+	defer active_mutex.Unlock()
+	return active_profiles
+}
+
+func get_active_filter() *piper.Filter {
+	active_mutex.Lock()
+	defer active_mutex.Unlock()
+	return active_filter
+}
+
+// new_session_context is cancelled when the sessions are dropped through the admin socket,
+// the cause tells the peer why. It is registered before the transport is set up, a disconnect
+// since wait_if_paused cancels it right away
+func new_session_context(parent context.Context, session string) (context.Context, context.CancelCauseFunc) {
+	active_mutex.Lock()
+	defer active_mutex.Unlock()
+	ctx, cancel := context.WithCancelCause(parent)
+	session_cancels[session] = cancel
+	if paused {
+		cancel(transport.NewShutdown(transport.DISCONNECT))
+	}
+	// a reconnect requested before this session is done
+	select {
+	case <-resume:
+	default:
+	}
+	return ctx, func(cause error) {
+		active_mutex.Lock()
+		delete(session_cancels, session)
+		active_mutex.Unlock()
+		cancel(cause)
+	}
+}
+
+// cancel_session drops one session
+func cancel_session(session string, cause error) {
+	active_mutex.Lock()
+	defer active_mutex.Unlock()
+	if cancel, ok := session_cancels[session]; ok {
+		cancel(cause)
+	}
+}
+
+// cancel_sessions drops all sessions, active_mutex is held
+func cancel_sessions(cause error) {
+	for _, cancel := range session_cancels {
+		cancel(cause)
+	}
+}
+
+// wait_if_paused blocks while the service is disconnected through the admin socket.
+// Returns false when ctx is done
+func wait_if_paused(ctx context.Context) bool {
+	active_mutex.Lock()
+	is_paused := paused
+	active_mutex.Unlock()
+	if !is_paused {
+		return true
+	}
+	logger.Info("Disconnected by admin. Waiting for reconnect")
+	select {
+	case <-ctx.Done():
+		return false
+	case <-resume:
+		return true
+	}
+}
+
+// wait_backoff sleeps before the next reconnect. Cut short by ctx or by a reconnect through the admin socket
+func wait_backoff(ctx context.Context, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-resume:
+	}
+}
+
+// controller implements admin.Controller for the service loop
+type controller struct {
+	stats *stats.GlobalStats
+}
+
+func (v controller) Status() admin.Status {
+	mode := "client"
+	if server_mode {
+		mode = "server"
+	}
+	active_mutex.Lock()
+	is_paused := paused
+	active_mutex.Unlock()
+	result := admin.Status{
+		Mode:         mode,
+		Device:       device_name,
+		LocalAddress: laddr,
+		Uptime:       time.Since(process_started).Round(time.Second).String(),
+		Paused:       is_paused,
+		Capture:      capture_status(),
+		Sessions:     []admin.Session{},
+		Stats: admin.Counters{
+			SentBytes:       v.stats.UploadedBytes(),
+			ReceivedBytes:   v.stats.DownloadedBytes(),
+			SentPackets:     v.stats.UploadedPackets(),
+			ReceivedPackets: v.stats.DownloadedPackets(),
+			Dropped:         v.stats.DroppedByReason(),
+			Errors:          v.stats.Errors(),
+			Reconnects:      v.stats.ReconnectedCount(),
+			RTT:             v.stats.RTT().String(),
+			Jitter:          v.stats.Jitter().String(),
+			EchoSent:        v.stats.EchoSent(),
+			EchoLost:        v.stats.EchoLost(),
+			Backoff:         v.stats.BackoffDelay().Round(time.Millisecond).String(),
+			FailedAttempts:  v.stats.BackoffAttempts(),
+		},
+	}
+	for _, pipe := range get_active_pipes() {
+		if pipe.Started().IsZero() {
+			continue
+		}
+		result.Sessions = append(result.Sessions, admin.Session{
+			Peer:            pipe.Transport.PeerName(),
+			Profile:         pipe.Profile(),
+			RemoteAddress:   pipe.Transport.RemoteAddr(),
+			Uptime:          time.Since(pipe.Started()).Round(time.Second).String(),
+			MTU:             pipe.MTU(),
+			RoutesRequested: pipe.Announced(),
+			RoutesInstalled: pipe.InstalledRoutes(),
+			Transport:       pipe.Transport.GetPoolStats(),
+		})
+	}
+	return result
+}
+
+func (v controller) Disconnect() error {
+	active_mutex.Lock()
+	defer active_mutex.Unlock()
+	paused = true
+	// a pending reconnect must not end the pause
+	select {
+	case <-resume:
+	default:
+	}
+	cancel_sessions(transport.NewShutdown(transport.DISCONNECT))
+	return nil
+}
+
+func (v controller) Reconnect() error {
+	active_mutex.Lock()
+	defer active_mutex.Unlock()
+	paused = false
+	// wakes up the pause or the wait between reconnects
+	select {
+	case resume <- struct{}{}:
+	default:
+	}
+	cancel_sessions(transport.NewShutdown(transport.RECONNECT))
+	return nil
+}
+
+// AddRoute asks the peer to route cidr into the tunnel, like -route does at the start of a session
+func (v controller) AddRoute(cidr string) error {
+	pipe, err := get_active_pipe()
+	if err != nil {
+		return err
+	}
+	return pipe.AnnounceRoute(cidr)
+}
+
+func (v controller) DelRoute(cidr string) error {
+	pipe, err := get_active_pipe()
+	if err != nil {
+		return err
+	}
+	return pipe.WithdrawRoute(cidr)
+}
+
+// Reload re-reads the filter rules and the profiles and applies them to the running sessions
+func (v controller) Reload() error {
+	if filter_file == "" && profiles_dir == "" {
+		return errors.New("nothing to reload, no -filter or -profiles given")
+	}
+	if filter_file != "" {
+		if err := reload_filter(); err != nil {
+			return err
+		}
+	}
+	if profiles_dir != "" {
+		profiles, err := profile.Load(profiles_dir)
+		if err != nil {
+			return err
+		}
+		active_mutex.Lock()
+		active_profiles = profiles
+		active_mutex.Unlock()
+		logger.Info("Reloaded profiles", "dir", profiles_dir, "profiles", len(profiles.Profiles))
+		apply_profiles()
+	}
+	return nil
+}
+
+func reload_filter() error {
+	filter, err := piper.LoadFilter(filter_file)
+	if err != nil {
+		return err
+	}
+	active_mutex.Lock()
+	active_filter = filter
+	pipes := slices.Clone(active_pipes)
+	active_mutex.Unlock()
+	for _, pipe := range pipes {
+		pipe.SetFilter(filter)
+	}
+	logger.Info("Reloaded filter", "file", filter_file)
+	return nil
+}
+
+func capture_status() string {
+	path, filter := capture.File()
+	if path == "" || filter == "" {
+		return path
+	}
+	return fmt.Sprintf("%s (%s)", path, filter)
+}
+
+func (v controller) StartCapture(path string, filter string) error {
+	return capture.Start(path, filter, int64(capture_size), capture_files)
+}
+
+func (v controller) StopCapture() error {
+	return capture.Stop()
+}
+
+func (v controller) StreamCapture(out io.Writer, filter string, done <-chan struct{}) error {
+	return capture.Stream(out, filter, done)
+}
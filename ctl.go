@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/wushilin/go-vpn/admin"
+)
+
+// run_ctl implements `go-vpn ctl [-socket path] [-json] <command> [args]`
+func run_ctl(args []string) int {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := flags.String("socket", admin.DEFAULT_SOCKET, "Admin socket of the running go-vpn")
+	as_json := flags.Bool("json", false, "Print the raw JSON response")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s ctl [-socket path] [-json] <command> [args]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Commands:\n")
+		fmt.Fprintf(flags.Output(), "  status            show peer, uptime, addresses, routes and stats\n")
+		fmt.Fprintf(flags.Output(), "  disconnect        drop the session and stop reconnecting\n")
+		fmt.Fprintf(flags.Output(), "  reconnect         drop the session (if any) and connect again\n")
+		fmt.Fprintf(flags.Output(), "  add-route <cidr>  ask the peer to route cidr into the tunnel, like -route\n")
+		fmt.Fprintf(flags.Output(), "  del-route <cidr>  withdraw a route of add-route or -route from the peer\n")
+		fmt.Fprintf(flags.Output(), "  reload            re-read the configuration files\n")
+		fmt.Fprintf(flags.Output(), "  capture start <file> [filter]  capture to a pcapng file\n")
+		fmt.Fprintf(flags.Output(), "  capture stop                   stop the capture to file\n")
+		fmt.Fprintf(flags.Output(), "  capture stream [filter]        write a pcapng capture to stdout\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+	request := admin.Request{
+		Command: flags.Arg(0),
+		Args:    flags.Args()[1:],
+	}
+	if request.Command == admin.CMD_CAPTURE && len(request.Args) > 0 && request.Args[0] == admin.CAPTURE_STREAM {
+		if err := admin.Stream(*socket, request, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+	response, err := admin.Call(*socket, request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 1
+	}
+	if *as_json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(response)
+	} else if !response.OK {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", response.Error)
+	} else if response.Status != nil {
+		print_status(response.Status)
+	} else {
+		fmt.Println(response.Message)
+	}
+	if !response.OK {
+		return 1
+	}
+	return 0
+}
+
+func print_status(status *admin.Status) {
+	fmt.Printf("Mode:      %s\n", status.Mode)
+	fmt.Printf("Device:    %s %s\n", status.Device, status.LocalAddress)
+	fmt.Printf("Uptime:    %s\n", status.Uptime)
+	if status.Paused {
+		fmt.Printf("State:     disconnected by admin\n")
+	} else if len(status.Sessions) == 0 {
+		fmt.Printf("State:     connecting\n")
+	} else {
+		fmt.Printf("State:     connected\n")
+	}
+	if status.Capture != "" {
+		fmt.Printf("Capture:   %s\n", status.Capture)
+	}
+	for _, session := range status.Sessions {
+		fmt.Printf("\nPeer:      %s (%s)\n", session.Peer, session.RemoteAddress)
+		fmt.Printf("  Uptime:    %s\n", session.Uptime)
+		fmt.Printf("  MTU:       %d\n", session.MTU)
+		if session.Profile != "" {
+			fmt.Printf("  Profile:   %s\n", session.Profile)
+		}
+		fmt.Printf("  Requested: %s\n", strings.Join(session.RoutesRequested, " "))
+		fmt.Printf("  Installed: %s\n", strings.Join(session.RoutesInstalled, " "))
+		fmt.Printf("  Buffers:   Borrowed: %d Created: %d Returned: %d Destroyed: %d\n",
+			session.Transport.Borrowed, session.Transport.Created, session.Transport.Returned, session.Transport.Destroyed)
+	}
+	counters := status.Stats
+	fmt.Printf("\nSent:      %s (%d packets)\n", humanize.Bytes(counters.SentBytes), counters.SentPackets)
+	fmt.Printf("Received:  %s (%d packets)\n", humanize.Bytes(counters.ReceivedBytes), counters.ReceivedPackets)
+	fmt.Printf("Reconnect: %d (backoff %s after %d failures)\n", counters.Reconnects, counters.Backoff, counters.FailedAttempts)
+	fmt.Printf("RTT:       %s (jitter %s, lost %d/%d)\n", counters.RTT, counters.Jitter, counters.EchoLost, counters.EchoSent)
+	print_labeled("Dropped", counters.Dropped)
+	print_labeled("Errors", counters.Errors)
+}
+
+func print_labeled(title string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%-10s %s: %d\n", title+":", key, values[key])
+	}
+}
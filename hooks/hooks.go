@@ -0,0 +1,201 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wushilin/go-vpn/logging"
+)
+
+// Events a hook can be attached to
+const EVENT_UP = "up"
+const EVENT_DOWN = "down"
+const EVENT_ROUTE_ADD = "route-add"
+const EVENT_ROUTE_DEL = "route-del"
+const EVENT_RECONNECT = "reconnect"
+
+var EVENTS = []string{EVENT_UP, EVENT_DOWN, EVENT_ROUTE_ADD, EVENT_ROUTE_DEL, EVENT_RECONNECT}
+
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+// Events waiting for their hooks. When the hooks can't keep up, new events are dropped
+const QUEUE = 256
+
+var logger = logging.For(logging.HOOKS)
+
+// Event describes what happened, passed to the scripts as GOVPN_* environment variables
+// and to the webhook as JSON
+type Event struct {
+	Name          string    `json:"event"`
+	Time          time.Time `json:"time"`
+	Mode          string    `json:"mode"`
+	Device        string    `json:"device"`
+	LocalAddress  string    `json:"local_address"`
+	Session       string    `json:"session,omitempty"`
+	Peer          string    `json:"peer,omitempty"`
+	RemoteAddress string    `json:"remote_address,omitempty"`
+	MTU           int       `json:"mtu,omitempty"`
+	// The route added or removed
+	Route string `json:"route,omitempty"`
+	// Routes installed for the peer
+	Routes     []string `json:"routes,omitempty"`
+	Reconnects uint64   `json:"reconnects,omitempty"`
+}
+
+func (v Event) environment() []string {
+	return []string{
+		"GOVPN_EVENT=" + v.Name,
+		"GOVPN_MODE=" + v.Mode,
+		"GOVPN_DEVICE=" + v.Device,
+		"GOVPN_LOCAL_ADDRESS=" + v.LocalAddress,
+		"GOVPN_SESSION=" + v.Session,
+		"GOVPN_PEER=" + v.Peer,
+		"GOVPN_REMOTE_ADDRESS=" + v.RemoteAddress,
+		"GOVPN_MTU=" + strconv.Itoa(v.MTU),
+		"GOVPN_ROUTE=" + v.Route,
+		"GOVPN_ROUTES=" + strings.Join(v.Routes, " "),
+		"GOVPN_RECONNECTS=" + strconv.FormatUint(v.Reconnects, 10),
+	}
+}
+
+// Hooks runs a script per event and posts every event to a webhook. The hooks run one at a time
+// in the order of the events, in the background, each limited by Timeout
+type Hooks struct {
+	// Executable per event name, empty events are skipped
+	Scripts map[string]string
+	// Receives every event as a JSON POST. Empty disables the webhook
+	URL     string
+	Timeout time.Duration
+	// Describe this side in every event
+	Mode         string
+	Device       string
+	LocalAddress string
+
+	mutex  sync.Mutex
+	closed bool
+	queue  chan Event
+	done   chan struct{}
+}
+
+// New starts the configured hooks. Returns nil when no script and no URL is set, Fire on nil does nothing
+func New(config *Hooks) *Hooks {
+	configured := config.URL != ""
+	for _, script := range config.Scripts {
+		configured = configured || script != ""
+	}
+	if !configured {
+		return nil
+	}
+	result := config
+	if result.Timeout <= 0 {
+		result.Timeout = DEFAULT_TIMEOUT
+	}
+	result.queue = make(chan Event, QUEUE)
+	result.done = make(chan struct{})
+	go result.run()
+	return result
+}
+
+// Fire queues the event and returns immediately
+func (v *Hooks) Fire(event Event) {
+	if v == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.Mode = v.Mode
+	event.Device = v.Device
+	event.LocalAddress = v.LocalAddress
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.closed {
+		logger.Warn("Hooks closed, event dropped", "event", event.Name, "session", event.Session)
+		return
+	}
+	select {
+	case v.queue <- event:
+	default:
+		logger.Warn("Hook queue full, event dropped", "event", event.Name, "session", event.Session)
+	}
+}
+
+// Close waits for the queued events to be handled, later events are dropped
+func (v *Hooks) Close() {
+	if v == nil {
+		return
+	}
+	v.mutex.Lock()
+	if !v.closed {
+		v.closed = true
+		close(v.queue)
+	}
+	v.mutex.Unlock()
+	<-v.done
+}
+
+func (v *Hooks) run() {
+	defer close(v.done)
+	for event := range v.queue {
+		if script := v.Scripts[event.Name]; script != "" {
+			v.exec(script, event)
+		}
+		if v.URL != "" {
+			v.post(event)
+		}
+	}
+}
+
+func (v *Hooks) exec(script string, event Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), v.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Env = append(os.Environ(), event.environment()...)
+	// don't wait for children of the script still holding the output
+	cmd.WaitDelay = time.Second
+	started := time.Now()
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Error("Hook timed out", "event", event.Name, "script", script, "timeout", v.Timeout, "session", event.Session)
+		return
+	}
+	if err != nil {
+		logger.Error("Hook failed", "event", event.Name, "script", script, "error", err, "output", string(output), "session", event.Session)
+		return
+	}
+	logger.Info("Hook done", "event", event.Name, "script", script, "took", time.Since(started), "session", event.Session)
+	logger.Debug("Hook output", "event", event.Name, "output", string(output))
+}
+
+func (v *Hooks) post(event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("Unable to encode event", "event", event.Name, "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), v.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, v.URL, bytes.NewReader(body))
+	if err != nil {
+		logger.Error("Webhook failed", "event", event.Name, "error", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		logger.Error("Webhook failed", "event", event.Name, "url", v.URL, "error", err, "session", event.Session)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		logger.Error("Webhook failed", "event", event.Name, "url", v.URL, "status", response.Status, "session", event.Session)
+		return
+	}
+	logger.Debug("Webhook done", "event", event.Name, "url", v.URL)
+}
@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Subsystems with their own verbosity
+const MAIN = "main"
+const TRANSPORT = "transport"
+const PIPER = "piper"
+const CONTROL = "control"
+const ROUTES = "routes"
+const HOOKS = "hooks"
+const PROXY = "proxy"
+
+const FORMAT_TEXT = "text"
+const FORMAT_JSON = "json"
+
+var base atomic.Pointer[slog.Handler]
+var default_level = new(slog.LevelVar)
+var levels sync.Map
+
+func init() {
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	base.Store(&handler)
+}
+
+// Setup configures the output of all loggers. level is the default level, subsystem_levels
+// overrides it per subsystem as `transport=debug,control=warn`
+func Setup(out io.Writer, format string, level string, subsystem_levels string) error {
+	parsed, err := parse_level(level)
+	if err != nil {
+		return err
+	}
+	// the subsystem handler filters, the base handler lets everything through
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler
+	switch format {
+	case FORMAT_TEXT:
+		handler = slog.NewTextHandler(out, options)
+	case FORMAT_JSON:
+		handler = slog.NewJSONHandler(out, options)
+	default:
+		return fmt.Errorf("invalid log format %s, expect text or json", format)
+	}
+	for _, next := range strings.Split(subsystem_levels, ",") {
+		next = strings.TrimSpace(next)
+		if next == "" {
+			continue
+		}
+		subsystem, value, found := strings.Cut(next, "=")
+		if !found {
+			return fmt.Errorf("invalid subsystem level %s, expect subsystem=level", next)
+		}
+		subsystem_level, err := parse_level(value)
+		if err != nil {
+			return err
+		}
+		level_of(subsystem).Set(subsystem_level)
+	}
+	default_level.Set(parsed)
+	base.Store(&handler)
+	// whatever still uses the log package ends up in the same output
+	slog.SetDefault(For(MAIN))
+	return nil
+}
+
+func parse_level(value string) (slog.Level, error) {
+	var result slog.Level
+	err := result.UnmarshalText([]byte(value))
+	return result, err
+}
+
+// level_of returns the level override of the subsystem, created on first use
+func level_of(subsystem string) *slog.LevelVar {
+	result, _ := levels.LoadOrStore(subsystem, new(slog.LevelVar))
+	return result.(*slog.LevelVar)
+}
+
+// For returns the logger of a subsystem. It can be created before Setup is called,
+// the output and the levels are looked up when a record is logged
+func For(subsystem string) *slog.Logger {
+	return slog.New(&handler{subsystem: subsystem}).With("subsystem", subsystem)
+}
+
+// handler applies the subsystem level and forwards to the configured base handler
+type handler struct {
+	subsystem string
+	// WithAttrs / WithGroup calls, replayed on the base handler
+	steps []func(slog.Handler) slog.Handler
+}
+
+func (v *handler) level() slog.Level {
+	if configured, ok := levels.Load(v.subsystem); ok {
+		return configured.(*slog.LevelVar).Level()
+	}
+	return default_level.Level()
+}
+
+func (v *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= v.level()
+}
+
+func (v *handler) Handle(ctx context.Context, record slog.Record) error {
+	target := *base.Load()
+	for _, step := range v.steps {
+		target = step(target)
+	}
+	return target.Handle(ctx, record)
+}
+
+func (v *handler) with(step func(slog.Handler) slog.Handler) slog.Handler {
+	return &handler{
+		subsystem: v.subsystem,
+		steps:     append(v.steps[:len(v.steps):len(v.steps)], step),
+	}
+}
+
+func (v *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return v.with(func(h slog.Handler) slog.Handler {
+		return h.WithAttrs(attrs)
+	})
+}
+
+func (v *handler) WithGroup(name string) slog.Handler {
+	return v.with(func(h slog.Handler) slog.Handler {
+		return h.WithGroup(name)
+	})
+}
+
+// Fatal logs at error level and exits, the replacement of log.Fatal
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
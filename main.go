@@ -1,32 +1,113 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
-	"strings"
+	"strconv"
 	"syscall"
 	"time"
 
-	"golang.org/x/net/context"
+	"context"
 
 	"github.com/dustin/go-humanize"
 	"github.com/songgao/water"
+	"github.com/wushilin/go-vpn/admin"
+	"github.com/wushilin/go-vpn/backoff"
 	"github.com/wushilin/go-vpn/common"
+	"github.com/wushilin/go-vpn/hooks"
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/metrics"
+	"github.com/wushilin/go-vpn/netstack"
 	"github.com/wushilin/go-vpn/piper"
+	"github.com/wushilin/go-vpn/profile"
 	"github.com/wushilin/go-vpn/stats"
 	"github.com/wushilin/go-vpn/transport"
 )
 
 var server_mode bool
 var server_address string
+var server_order string
+var connect_timeout time.Duration
+var failback time.Duration
+var endpoints *transport.Endpoints
+
+// The server listens for the life of the process
+var listener *transport.QuicListener
 var bind_string string
 var laddr = ""
 var routes = ""
 var commonName = ""
 var device_name = ""
+var echo_interval time.Duration
+var echo_fail_limit int
+var drain_timeout time.Duration
+var max_clients int
+var client_to_client string
+var mtu int
+var mss_clamp string
+var filter_file string
+var profiles_dir string
+var push_dns string
+var push_search string
+var push_default_route bool
+var dns_mode string
+var full_tunnel bool
+var kill_switch bool
+var route_table string
+var route_metric int
+var fwmark_string string
+var fwmark int
+var route_rules string
+var route_conflict string
+var masquerade string
+var local_forwards_string string
+var remote_forwards_string string
+var local_forwards []piper.Forward
+var remote_forwards []piper.Forward
+var accept_forwards bool
+var rootless bool
+var proxy_address string
+var conflict_policy piper.ConflictPolicy
+var streams int
+var metrics_address string
+var admin_socket string
+var log_level string
+var log_format string
+var log_levels string
+var capture_file string
+var capture_filter string
+var capture_size_string string
+var capture_size uint64
+var capture_files int
+var hook_scripts = make(map[string]*string)
+var hook_url string
+var hook_timeout time.Duration
+var event_hooks *hooks.Hooks
+var backoff_initial time.Duration
+var backoff_max time.Duration
+var backoff_multiplier float64
+var backoff_jitter float64
+var backoff_reset time.Duration
+
+var logger = logging.For(logging.MAIN)
+
+// count_handshake_failure records why a session could not be set up
+func count_handshake_failure(v *stats.GlobalStats, err error) {
+	var handshake_error *transport.HandshakeError
+	if transport.IsRejected(err) {
+		v.IncreaseHandshakeFailure(transport.REASON_REJECTED)
+	} else if errors.As(err, &handshake_error) {
+		v.IncreaseHandshakeFailure(handshake_error.Reason)
+	}
+}
 
 func validate_params() {
 	if server_mode {
@@ -38,6 +119,10 @@ func validate_params() {
 			fmt.Printf("ERROR: Server mode can't accept server_address via -s flag")
 			os.Exit(1)
 		}
+		if rootless {
+			fmt.Printf("ERROR: -rootless is a client mode, the server requires a TUN device")
+			os.Exit(1)
+		}
 	} else {
 		if bind_string != "" {
 			fmt.Printf("ERROR: Client mode can't accept bind_string via -b flag")
@@ -47,11 +132,125 @@ func validate_params() {
 			fmt.Printf("ERROR: Client mode requires a server_address via -s flag")
 			os.Exit(1)
 		}
+		if kill_switch {
+			if err := common.HasNft(); err != nil {
+				fmt.Printf("ERROR: -kill-switch %s", err)
+				os.Exit(1)
+			}
+		}
+		// these change the host, which requires privileges
+		if rootless && (kill_switch || route_rules != "" || masquerade != "" || fwmark_string != "" || route_table != "" || route_metric != 0) {
+			fmt.Printf("ERROR: -rootless can't be combined with -kill-switch, -route-rule, -masquerade, -fwmark, -route-table or -route-metric")
+			os.Exit(1)
+		}
+		if rootless && (dns_mode == common.DNS_RESOLVED || dns_mode == common.DNS_RESOLVCONF) {
+			fmt.Printf("ERROR: -rootless resolves names through the tunnel itself, -dns-mode must be %s or %s", common.DNS_AUTO, common.DNS_OFF)
+			os.Exit(1)
+		}
+		var err error
+		endpoints, err = transport.ParseEndpoints(server_address, server_order)
+		if err != nil {
+			fmt.Printf("ERROR: -s / -server-order: %s", err)
+			os.Exit(1)
+		}
+	}
+	if mss_clamp != "" && mss_clamp != "auto" {
+		if value, err := strconv.Atoi(mss_clamp); err != nil || value < 536 || value > 0xffff {
+			fmt.Printf("ERROR: -mss-clamp must be `auto` or a number between 536 and 65535")
+			os.Exit(1)
+		}
+	}
+	if streams < 1 || streams > transport.MAX_STREAMS {
+		fmt.Printf("ERROR: -streams must be between 1 and %d", transport.MAX_STREAMS)
+		os.Exit(1)
+	}
+	if mtu != 0 && mtu < piper.MIN_MTU {
+		fmt.Printf("ERROR: MTU must be at least %d, the IPv6 minimum", piper.MIN_MTU)
+		os.Exit(1)
+	}
+	if capture_size_string != "" {
+		var err error
+		capture_size, err = humanize.ParseBytes(capture_size_string)
+		if err != nil {
+			fmt.Printf("ERROR: -capture-size must be a size like 10MB")
+			os.Exit(1)
+		}
+	}
+	if backoff_initial <= 0 || backoff_max < backoff_initial || backoff_multiplier < 1 || backoff_jitter < 0 || backoff_jitter > 1 {
+		fmt.Printf("ERROR: -backoff-initial must be positive and at most -backoff-max, -backoff-multiplier at least 1, -backoff-jitter between 0 and 1")
+		os.Exit(1)
+	}
+	if dns_mode != common.DNS_AUTO && dns_mode != common.DNS_RESOLVED && dns_mode != common.DNS_RESOLVCONF && dns_mode != common.DNS_OFF {
+		fmt.Printf("ERROR: -dns-mode must be %s, %s, %s or %s", common.DNS_AUTO, common.DNS_RESOLVED, common.DNS_RESOLVCONF, common.DNS_OFF)
+		os.Exit(1)
+	}
+	if _, err := piper.DecodePush(push_config(nil).Encode()); err != nil {
+		fmt.Printf("ERROR: -push-dns: %s", err)
+		os.Exit(1)
+	}
+	if policy, err := piper.ParseConflictPolicy(route_conflict); err != nil {
+		fmt.Printf("ERROR: -route-conflict: %s", err)
+		os.Exit(1)
+	} else {
+		conflict_policy = policy
+	}
+	var err error
+	if local_forwards, err = piper.ParseForwards(local_forwards_string); err != nil {
+		fmt.Printf("ERROR: -L: %s", err)
+		os.Exit(1)
+	}
+	if remote_forwards, err = piper.ParseForwards(remote_forwards_string); err != nil {
+		fmt.Printf("ERROR: -R: %s", err)
+		os.Exit(1)
+	}
+	if masquerade != "" {
+		if err := common.HasNft(); err != nil {
+			fmt.Printf("ERROR: -masquerade %s", err)
+			os.Exit(1)
+		}
+	}
+	if route_metric < 0 {
+		fmt.Printf("ERROR: -route-metric must not be negative")
+		os.Exit(1)
+	}
+	if fwmark_string != "" {
+		var err error
+		fwmark, err = common.ParseMark(fwmark_string)
+		if err != nil || fwmark == 0 {
+			fmt.Printf("ERROR: -fwmark must be a mark other than 0, e.g. 0x51")
+			os.Exit(1)
+		}
+	}
+	for _, rule := range common.ToList(route_rules) {
+		if err := common.ParseRule(rule); err != nil {
+			fmt.Printf("ERROR: -route-rule: %s", err)
+			os.Exit(1)
+		}
+	}
+	if route_rules != "" && (route_table == "" || route_table == "main") {
+		fmt.Printf("ERROR: -route-rule requires a -route-table other than main")
+		os.Exit(1)
+	}
+	if max_clients < 1 {
+		fmt.Printf("ERROR: -max-clients must be at least 1")
+		os.Exit(1)
+	}
+	if client_to_client != piper.CLIENT_TO_CLIENT_ALLOW && client_to_client != piper.CLIENT_TO_CLIENT_DENY {
+		fmt.Printf("ERROR: -client-to-client must be %s or %s", piper.CLIENT_TO_CLIENT_ALLOW, piper.CLIENT_TO_CLIENT_DENY)
+		os.Exit(1)
+	}
+	if capture_files < 1 {
+		fmt.Printf("ERROR: -capture-files must be at least 1")
+		os.Exit(1)
+	}
+	if _, err := piper.ParseCaptureFilter(capture_filter); err != nil {
+		fmt.Printf("ERROR: -capture-filter: %s", err)
+		os.Exit(1)
 	}
 }
 
 func print_stats(v *stats.GlobalStats, ctx context.Context) {
-	log.Printf("Print Stats Started")
+	logger.Debug("Print Stats Started")
 	var run = true
 	for run {
 		select {
@@ -63,58 +262,248 @@ func print_stats(v *stats.GlobalStats, ctx context.Context) {
 			downloaded_str := humanize.Bytes(downloaded)
 			uploaded_str := humanize.Bytes(uploaded)
 			reconnected_count := v.ReconnectedCount()
-			log.Printf("Sent: %s, Received: %s, Reconnect Count: %d", uploaded_str, downloaded_str, reconnected_count)
+			logger.Info("Stats", "sent", uploaded_str, "received", downloaded_str, "reconnects", reconnected_count, "backoff", v.BackoffDelay(), "failed_attempts", v.BackoffAttempts(),
+				"packets_sent", v.UploadedPackets(), "packets_received", v.DownloadedPackets(), "dropped", v.Dropped(),
+				"rtt", v.RTT(), "jitter", v.Jitter(), "echo_lost", v.EchoLost(), "echo_sent", v.EchoSent())
+			for reason, count := range v.DroppedByReason() {
+				logger.Info("Dropped", "reason", reason, "count", count)
+			}
+			for kind, count := range v.Errors() {
+				logger.Info("Errors", "kind", kind, "count", count)
+			}
+			for rule, hits := range v.RuleHits() {
+				logger.Info("Filter", "rule", rule, "hits", hits)
+			}
 		}
-		//log.Println("Transport Stats: ", v.Transport.GetStats())
+		//logger.Debug("Transport Stats", "stats", v.Transport.GetStats())
 	}
-	log.Printf("Print Stats Stopped")
+	logger.Debug("Print Stats Stopped")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(run_ctl(os.Args[2:]))
+	}
+	os.Exit(run_service())
+}
 
-	stop_context, cancel_function := context.WithCancel(context.TODO())
+// exit_code tells how the service stopped: 0 for SIGINT and SIGTERM, 128 + the signal number for the others
+func exit_code(stopped_by os.Signal) int {
+	signal_number, ok := stopped_by.(syscall.Signal)
+	if !ok || signal_number == syscall.SIGINT || signal_number == syscall.SIGTERM {
+		return 0
+	}
+	return 128 + int(signal_number)
+}
+
+// run_service runs sessions until a signal stops it, returns the exit code
+func run_service() int {
+	stop_context, cancel_function := context.WithCancelCause(context.TODO())
 	flag.BoolVar(&server_mode, "l", false, "Listen. This means it will run as server mode. Default is client mode")
-	flag.StringVar(&server_address, "s", "", "Server to Connect To. Required client param; no default")
+	flag.StringVar(&server_address, "s", "", "Server to Connect To, or a comma separated list host:port,host:port. Required client param; no default")
+	flag.StringVar(&server_order, "server-order", transport.ORDER_PRIORITY, "Try the servers (and the addresses of each server name) in `priority` order or in random order")
+	flag.DurationVar(&connect_timeout, "connect-timeout", 5*time.Second, "Give up on a server address after this long and try the next")
+	flag.DurationVar(&failback, "failback", 0, "With -server-order priority, check the preferred servers this often and reconnect to them once they answer. Default is disabled")
+	flag.IntVar(&max_clients, "max-clients", 1, "Server: sessions running at the same time, more clients are rejected as busy")
+	flag.StringVar(&client_to_client, "client-to-client", piper.CLIENT_TO_CLIENT_ALLOW, "Server: `allow` or deny the clients to reach the networks announced by other clients")
 	flag.StringVar(&bind_string, "b", "", "Bind address. Required server param; no default")
 	flag.StringVar(&laddr, "laddr", "", "Local address in CIDR notation(e.g. 10.1.0.10/24). Default server: `10.54.0.10/24`, default client: `10.54.0.11/24`")
 	flag.StringVar(&routes, "route", "", "Network to ask remote to route to local in cidr;cidr; format (10.0.0.0/8;192.168.44.7/32;...). Default is local address only")
 	flag.StringVar(&commonName, "commonName", "", "Allowed remote certificate common name, default is No Check")
 	flag.StringVar(&device_name, "tunname", "TUN17", "Use alternate device name. Default is `TUN17`")
+	flag.DurationVar(&echo_interval, "echo-interval", 5*time.Second, "Interval between ECHO probes on the control channel. 0 disables probing")
+	flag.IntVar(&echo_fail_limit, "echo-fail", 3, "Reconnect after this many ECHO probes in a row are lost")
+	flag.DurationVar(&drain_timeout, "drain-timeout", piper.DRAIN_TIMEOUT, "When stopping, wait this long for the peer to acknowledge the GOODBYE while packets in flight are delivered")
+	flag.IntVar(&mtu, "mtu", 0, fmt.Sprintf("Tunnel MTU to propose. The smaller proposal of both sides is used. Default is %d", piper.DEFAULT_MTU))
+	flag.StringVar(&mss_clamp, "mss-clamp", "", "Clamp MSS of TCP SYN packets crossing the tunnel. `auto` derives it from the MTU, or a fixed value. Default is no clamping")
+	flag.StringVar(&push_dns, "push-dns", "", "Server: comma separated name servers the clients use while connected")
+	flag.StringVar(&push_search, "push-search", "", "Server: comma separated search domains of the clients while connected")
+	flag.BoolVar(&push_default_route, "push-default-route", false, "Server: clients send all their traffic into the tunnel")
+	flag.StringVar(&dns_mode, "dns-mode", common.DNS_AUTO, "Client: apply the DNS pushed by the server with `auto`, resolved (systemd-resolved), resolvconf (/etc/resolv.conf) or off")
+	flag.BoolVar(&full_tunnel, "full-tunnel", false, "Client: send all traffic into the tunnel, the server stays reachable through the current gateway")
+	flag.BoolVar(&kill_switch, "kill-switch", false, "Client: block the traffic outside the tunnel until the client stops, also while reconnecting. Requires nftables")
+	flag.StringVar(&route_table, "route-table", "", "Install the routes of the tunnel in this routing table, a number or a name of /etc/iproute2/rt_tables. Default is the main table")
+	flag.IntVar(&route_metric, "route-metric", 0, "Metric of the routes of the tunnel, higher makes them a backup of other routes. Default is the kernel default")
+	flag.StringVar(&route_rules, "route-rule", "", "Comma separated ip rules sending packets to -route-table: `from <prefix>`, fwmark <mark> or not fwmark <mark>")
+	flag.StringVar(&route_conflict, "route-conflict", "", "What to do with requested routes conflicting with the routes of the host, per class (duplicate, overlapping, local): skip, replace or fail, e.g. `local=fail`. Default is duplicate=skip,overlapping=replace,local=skip")
+	flag.StringVar(&masquerade, "masquerade", "", "Comma separated LAN interfaces, e.g. `eth0`: packets from the tunnel leaving through them take the address of the interface (nftables). Default is no NAT")
+	flag.StringVar(&local_forwards_string, "L", "", "Comma separated ports forwarded to the other side, `[tcp/|udp/][host]:port=host:port`: listen here, connect there (requires -accept-forward on the peer). Default is none")
+	flag.StringVar(&remote_forwards_string, "R", "", "Comma separated ports forwarded from the other side, `[tcp/|udp/][host]:port=host:port`: listen there (requires -accept-forward on the peer), connect here. Default is none")
+	flag.BoolVar(&accept_forwards, "accept-forward", false, "Listen for the -R forwards and connect for the -L forwards of the peer. Default is refusing them")
+	flag.BoolVar(&rootless, "rootless", false, "Client: run without privileges on a userspace network stack instead of a TUN device, reached through the -proxy")
+	flag.StringVar(&proxy_address, "proxy", "127.0.0.1:1080", "Client with -rootless: SOCKS5 and HTTP CONNECT proxy into the tunnel listening on this address")
+	flag.StringVar(&fwmark_string, "fwmark", "", "Set this firewall mark (SO_MARK) on the QUIC socket, e.g. 0x51, to keep the tunnel traffic out of the tunnel with ip rules. Default is unmarked")
+	flag.StringVar(&profiles_dir, "profiles", "", "Server: directory of client profiles, one <identity>.conf per certificate common name or SAN. Default is no profiles")
+	flag.StringVar(&filter_file, "filter", "", "Packet filter rules file applied to the traffic crossing the tunnel. Default is allow everything")
+	flag.IntVar(&streams, "streams", transport.STREAMS, fmt.Sprintf("Number of QUIC data streams the client opens, at most %d. The server follows the client", transport.MAX_STREAMS))
+	flag.StringVar(&metrics_address, "metrics", "", "Expose Prometheus metrics on http://<address>/metrics, e.g. 127.0.0.1:9100. Default is disabled")
+	flag.StringVar(&admin_socket, "admin", "", fmt.Sprintf("Serve the admin socket used by `go-vpn ctl` at this path, e.g. %s. Default is disabled", admin.DEFAULT_SOCKET))
+	flag.StringVar(&capture_file, "capture", "", "Capture the packets crossing the tunnel to this pcapng file. Default is disabled")
+	flag.StringVar(&capture_filter, "capture-filter", "", "Only capture packets matching this filter, e.g. `tcp port 443 and out`")
+	flag.StringVar(&capture_size_string, "capture-size", "", "Rotate the capture file when it reaches this size, e.g. 10MB. Default is no limit")
+	flag.IntVar(&capture_files, "capture-files", piper.DEFAULT_CAPTURE_FILES, "Capture files kept when rotating, including the current one")
+	for _, event := range hooks.EVENTS {
+		hook_scripts[event] = flag.String("hook-"+event, "", fmt.Sprintf("Run this executable on %s, described by GOVPN_* environment variables", event))
+	}
+	flag.StringVar(&hook_url, "hook-url", "", "POST every hook event as JSON to this URL. Default is disabled")
+	flag.DurationVar(&hook_timeout, "hook-timeout", hooks.DEFAULT_TIMEOUT, "Time limit of each hook script and webhook call")
+	flag.DurationVar(&backoff_initial, "backoff-initial", backoff.DEFAULT_INITIAL, "Wait before reconnecting after the first failure")
+	flag.DurationVar(&backoff_max, "backoff-max", backoff.DEFAULT_MAX, "Longest wait between reconnects")
+	flag.Float64Var(&backoff_multiplier, "backoff-multiplier", backoff.DEFAULT_MULTIPLIER, "Growth of the wait on every failure in a row")
+	flag.Float64Var(&backoff_jitter, "backoff-jitter", backoff.DEFAULT_JITTER, "Randomize each wait by up to this fraction of it, 0 disables")
+	flag.DurationVar(&backoff_reset, "backoff-reset", backoff.DEFAULT_RESET, "A session up for this long resets the wait to -backoff-initial")
+	flag.StringVar(&log_level, "log-level", "info", "Log level: debug, info, warn or error")
+	flag.StringVar(&log_format, "log-format", logging.FORMAT_TEXT, "Log format: text or json")
+	flag.StringVar(&log_levels, "log-levels", "", "Log level per subsystem (main, transport, piper, control, routes, hooks), e.g. `transport=debug,control=warn`")
 	flag.Parse()
+	if err := logging.Setup(os.Stderr, log_format, log_level, log_levels); err != nil {
+		fmt.Printf("ERROR: %s", err)
+		os.Exit(1)
+	}
 	var global_stats = stats.New()
 	go print_stats(global_stats, stop_context)
+	if metrics_address != "" {
+		go func() {
+			if err := metrics.Serve(metrics_address, global_stats, get_active_transports); err != nil {
+				logging.Fatal(logger, "Metrics listener failed", "error", err)
+			}
+		}()
+	}
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT, syscall.SIGHUP, syscall.SIGQUIT)
+	// the signal stopping the service, sent before the sessions are stopped
+	stopped := make(chan os.Signal, 1)
 	go func() {
-		<-sigs
+		stopped_by := <-sigs
+		stopped <- stopped_by
 		fmt.Println("")
-		cancel_function()
+		logger.Info("Stopping", "signal", stopped_by)
+		cancel_function(transport.NewShutdown(transport.SHUTDOWN))
 	}()
 	// // // if laddr == "" {
 	// // // 	if server_mode {
 	// // // 		laddr = "10.54.0.10/24"
-	// // // 		log.Printf("Default local addres set to %s\n", laddr)
+	// // // 		logger.Info("Default local addres set", "laddr", laddr)
 	// // // 	} else {
 	// // // 		laddr = "10.54.0.11/24"
-	// // // 		log.Printf("Default local addres set to %s\n", laddr)
+	// // // 		logger.Info("Default local addres set", "laddr", laddr)
 	// // // 	}
 	// // // }
 	if routes == "" {
-		log.Printf("Not requesting additional routing from other party. you can specify -route parameter to request")
+		logger.Info("Not requesting additional routing from other party. you can specify -route parameter to request")
 	}
 	validate_params()
+	if profiles_dir != "" {
+		var err error
+		active_profiles, err = profile.Load(profiles_dir)
+		if err != nil {
+			logging.Fatal(logger, "Unable to load profiles", "error", err)
+		}
+		logger.Info("Loaded profiles", "dir", profiles_dir, "profiles", len(active_profiles.Profiles))
+	}
+	if filter_file != "" {
+		var err error
+		active_filter, err = piper.LoadFilter(filter_file)
+		if err != nil {
+			logging.Fatal(logger, "Unable to load filter", "error", err)
+		}
+	}
+	if capture_file != "" {
+		if err := capture.Start(capture_file, capture_filter, int64(capture_size), capture_files); err != nil {
+			logging.Fatal(logger, "Unable to start capture", "error", err)
+		}
+		defer capture.Stop()
+	}
+	if admin_socket != "" {
+		admin_listener, err := admin.Serve(admin_socket, controller{stats: global_stats})
+		if err != nil {
+			logging.Fatal(logger, "Unable to serve admin socket", "error", err)
+		}
+		defer admin_listener.Close()
+	}
+	event_hooks = new_hooks()
+	common.RouteTable = route_table
+	common.RouteMetric = route_metric
+	for _, rule := range common.ToList(route_rules) {
+		if !common.AddRule(rule) {
+			logging.Fatal(logger, "Unable to add ip rule", "rule", rule, "table", route_table)
+		}
+		defer common.DelRule(rule)
+	}
+	if masquerade != "" {
+		if err := common.EnableMasquerade(device_name, common.ToList(masquerade)); err != nil {
+			logging.Fatal(logger, "Unable to masquerade", "interfaces", masquerade, "error", err)
+		}
+		logger.Info("Masquerading the tunnel", "device", device_name, "interfaces", masquerade)
+		defer func() {
+			if err := common.DisableMasquerade(); err != nil {
+				logger.Error("Unable to remove the masquerading, remove it with `nft delete table inet "+common.MASQUERADE_TABLE+"`", "error", err)
+			}
+		}()
+	}
 	if server_mode {
-		log.Println("Mode: Server, Bind:", bind_string)
+		var err error
+		listener, err = transport.NewQuicListener(server_config(""), bind_string, max_clients)
+		if err != nil {
+			logging.Fatal(logger, "Unable to listen", "bind", bind_string, "error", err)
+		}
+		defer listener.Close()
+		logger.Info("Mode: Server", "bind", bind_string)
 	} else {
-		log.Println("Mode: Client, Target:", server_address)
+		logger.Info("Mode: Client", "servers", server_address, "order", server_order)
+	}
+
+	var err error
+	if server_mode {
+		err = run_server(stop_context, global_stats)
+	} else {
+		run_client(stop_context, global_stats)
+	}
+	// the down and route-del hooks of the last session
+	event_hooks.Close()
+	if err != nil {
+		logger.Error("Stopped", "error", err)
+		return 1
 	}
+	select {
+	case stopped_by := <-stopped:
+		return exit_code(stopped_by)
+	default:
+		logger.Error("Stopped without a signal")
+		return 1
+	}
+}
 
+// run_client keeps one session to the servers up until stop_context is done
+func run_client(stop_context context.Context, global_stats *stats.GlobalStats) {
+	retry := &backoff.Backoff{
+		Initial:    backoff_initial,
+		Max:        backoff_max,
+		Multiplier: backoff_multiplier,
+		Jitter:     backoff_jitter,
+		ResetAfter: backoff_reset,
+	}
+	var rootless_stack *netstack.Stack
+	if rootless {
+		rootless_stack = start_rootless()
+		defer rootless_stack.Close()
+	}
+	if kill_switch {
+		if err := update_kill_switch(stop_context); err != nil {
+			logging.Fatal(logger, "Unable to enable the kill switch", "error", err)
+		}
+		defer func() {
+			if err := common.DisableKillSwitch(); err != nil {
+				logger.Error("Unable to disable the kill switch, remove it with `nft delete table inet "+common.KILL_SWITCH_TABLE+"`", "error", err)
+			}
+		}()
+	}
 	run := true
 	for run {
 		select {
 		case <-stop_context.Done():
-			log.Println("Context stopped. Breaking")
+			logger.Info("Context stopped. Breaking")
 			run = false
 		default:
 		}
@@ -122,98 +511,307 @@ func main() {
 			// no need to cleanup, routes and TUN devices will be deleted automatically
 			break
 		}
-		func() {
+		if !wait_if_paused(stop_context) {
+			continue
+		}
+		session := new_session_id()
+		session_context, cancel_session := new_session_context(stop_context, session)
+		session_logger := logger.With("session", session)
+		uptime := func() (uptime time.Duration) {
+			defer cancel_session(nil)
 			var iface *water.Interface
+			var device piper.Device
 			var trans transport.Transport
 			var pipe *piper.Pipe
+			var endpoint transport.Endpoint
 			defer func() {
 				if iface != nil {
-					log.Println("Deleting interface ", device_name)
-					iface.Close()
+					address := laddr
+					if pipe != nil {
+						// may be assigned by the server
+						address = pipe.Address
+					}
+					delete_device(iface, address, session_logger)
 				}
 				if pipe != nil {
-					log.Println("Closing pipe")
+					session_logger.Debug("Closing pipe")
 					pipe.Close()
 				}
 			}()
-			config := water.Config{
-				DeviceType: water.TUN,
+			if rootless_stack != nil {
+				reset_rootless(rootless_stack, session_logger)
+				device = rootless_stack
+			} else {
+				iface = create_device(session_logger)
+				device = tun_device(iface, session_logger)
 			}
-			config.Name = device_name
 			var err error
-			iface, err = water.New(config)
+			trans, endpoint, err = setup_client_transport(session_context, commonName, session)
 			if err != nil {
-				log.Fatal(err)
+				session_logger.Warn("Setup Transport Error", "error", err)
+				count_handshake_failure(global_stats, err)
+				return
 			}
-			if !common.BringUpLink(device_name) {
-				log.Fatalf("Failed to bring link UP\n")
+			pipe = new_pipe(device, trans, session, global_stats, session_logger)
+			add_active_pipe(pipe)
+			defer remove_active_pipe(pipe)
+			if failback > 0 {
+				go run_failback(session_context, cancel_session, client_config(session), endpoint)
 			}
-			if laddr != "" {
-				log.Printf("Using specified local address %s\n", laddr)
-				if !common.SetIPAddress(device_name, laddr) {
-					log.Fatalf("Failed to set IP Address to %s\n", laddr)
-				}
+			run_pipe(session_context, pipe, global_stats, session_logger)
+			if session_context.Err() == nil {
+				// lost, not dropped on purpose: try the other servers first
+				endpoints.Failed(endpoint)
 			}
-			if server_mode {
-				trans, err = setup_server_transport(stop_context, commonName)
-			} else {
-				trans, err = setup_client_transport(stop_context, commonName)
+			if !pipe.Started().IsZero() {
+				uptime = time.Since(pipe.Started())
 			}
-			if err != nil {
-				log.Printf("Setup Transport Error: %s\n", err)
-				return
+			return uptime
+		}()
+		if stop_context.Err() != nil {
+			continue
+		}
+		if kill_switch {
+			// the servers may resolve to other addresses by now
+			if err := update_kill_switch(stop_context); err != nil {
+				logger.Warn("Unable to update the kill switch, keeping its rules", "error", err)
 			}
+		}
+		if retry.Healthy(uptime) {
+			global_stats.SetBackoff(0, 0)
+			continue
+		}
+		delay := retry.Next()
+		global_stats.SetBackoff(retry.Attempts(), delay)
+		logger.Info("Waiting before reconnecting", "delay", delay.Round(time.Millisecond), "attempts", retry.Attempts())
+		wait_backoff(stop_context, delay)
+	}
+}
 
-			pipe, err = piper.NewPipe(iface, trans, generate_routes(routes, laddr), global_stats)
-
-			if err != nil {
-				log.Fatal(err)
+// update_kill_switch lets only the tunnel and the current addresses of the servers through
+func update_kill_switch(ctx context.Context) error {
+	candidates, err := endpoints.Candidates(ctx)
+	if err != nil {
+		return err
+	}
+	var addresses []netip.Addr
+	for _, endpoint := range candidates {
+		address, err := netip.ParseAddrPort(endpoint.Address)
+		if err != nil {
+			return err
+		}
+		addresses = append(addresses, address.Addr())
+	}
+	// servers given by name must still resolve while the tunnel is down, through the resolvers of the host only
+	var resolvers []netip.Addr
+	for _, server := range endpoints.Servers {
+		host, _, _ := net.SplitHostPort(server)
+		if _, err := netip.ParseAddr(host); err != nil {
+			resolvers = common.HostResolvers()
+			if len(resolvers) == 0 {
+				logger.Warn("No name server found in "+common.RESOLV_CONF+", servers given by name won't resolve again", "server", server)
 			}
-			done := make(chan bool)
-			go func() {
-				errlocal := pipe.Run(stop_context, server_mode)
-				log.Printf("Link Down!")
-				if errlocal != nil {
-					log.Printf("The service didn't work well... %s", errlocal)
-					time.Sleep(3 * time.Second)
-				}
-				done <- true
-			}()
-			<-done
-			pipe.Close()
-			log.Println("Service Loop Ended. Restarting...")
-			global_stats.IncreaseReconnectCount()
-		}()
+			break
+		}
+	}
+	if err := common.EnableKillSwitch(device_name, addresses, resolvers); err != nil {
+		return err
 	}
+	logger.Info("Kill switch enabled", "device", device_name, "servers", addresses, "dns", resolvers)
+	return nil
 }
 
-func generate_routes(routes string, laddr string) []string {
-	result := make([]string, 0)
-	result = append(result, simplify(laddr))
-	result = append(result, common.ToArray(routes)...)
-	return result
+// create_device creates the TUN device, brings it up and assigns -laddr
+func create_device(logger *slog.Logger) *water.Interface {
+	config := water.Config{
+		DeviceType: water.TUN,
+	}
+	config.Name = device_name
+	iface, err := water.New(config)
+	if err != nil {
+		logging.Fatal(logger, "Unable to create TUN device", "device", device_name, "error", err)
+	}
+	if !common.BringUpLink(device_name) {
+		logging.Fatal(logger, "Failed to bring link UP", "device", device_name)
+	}
+	if laddr != "" {
+		logger.Info("Using specified local address", "laddr", laddr)
+		if !common.SetIPAddress(device_name, laddr) {
+			logging.Fatal(logger, "Failed to set IP Address", "laddr", laddr)
+		}
+	}
+	return iface
+}
+
+// tun_device wraps the TUN device for the pipes
+func tun_device(iface *water.Interface, logger *slog.Logger) piper.Device {
+	device, err := piper.NewTunDevice(iface)
+	if err != nil {
+		logging.Fatal(logger, "Unable to use TUN device", "device", device_name, "error", err)
+	}
+	return device
+}
+
+func delete_device(iface *water.Interface, address string, logger *slog.Logger) {
+	if address != "" && !common.DelIPAddress(device_name, address) {
+		logger.Warn("Failed to remove IP Address", "laddr", address)
+	}
+	logger.Info("Deleting interface", "device", device_name)
+	iface.Close()
+}
+
+// new_pipe sets up the pipe of a session with the settings of the flags
+func new_pipe(iface piper.Device, trans transport.Transport, session string, global_stats *stats.GlobalStats, logger *slog.Logger) *piper.Pipe {
+	pipe, err := piper.NewPipe(iface, trans, common.ToArray(routes), global_stats)
+	if err != nil {
+		logging.Fatal(logger, "Unable to create pipe", "error", err)
+	}
+	pipe.Session = session
+	pipe.Address = laddr
+	pipe.EchoInterval = echo_interval
+	pipe.EchoFailLimit = echo_fail_limit
+	pipe.LocalMTU = mtu
+	pipe.MSSClamp = parse_mss_clamp(mss_clamp)
+	pipe.Filter = get_active_filter()
+	pipe.Capture = capture
+	pipe.Hooks = event_hooks
+	pipe.DrainTimeout = drain_timeout
+	pipe.DNSMode = dns_mode
+	pipe.FullTunnel = full_tunnel
+	pipe.Conflicts = conflict_policy
+	pipe.LocalForwards = local_forwards
+	pipe.RemoteForwards = remote_forwards
+	pipe.AcceptForwards = accept_forwards
+	return pipe
+}
+
+// run_pipe runs the session until it is lost or ctx is done
+func run_pipe(ctx context.Context, pipe *piper.Pipe, global_stats *stats.GlobalStats, logger *slog.Logger) {
+	err := pipe.Run(ctx, server_mode)
+	logger.Info("Link Down!")
+	if transport.IsRejected(err) {
+		logger.Warn("Rejected by the server, it is full")
+		count_handshake_failure(global_stats, err)
+	} else if err != nil {
+		logger.Warn("The service didn't work well...", "error", err)
+		count_handshake_failure(global_stats, err)
+	}
+	pipe.Close()
+	logger.Info("Service Loop Ended. Restarting...")
+	global_stats.IncreaseReconnectCount()
+	event_hooks.Fire(hooks.Event{Name: hooks.EVENT_RECONNECT, Session: pipe.Session, Reconnects: global_stats.ReconnectedCount()})
+}
+
+func new_hooks() *hooks.Hooks {
+	mode := "client"
+	if server_mode {
+		mode = "server"
+	}
+	scripts := make(map[string]string)
+	for event, script := range hook_scripts {
+		scripts[event] = *script
+	}
+	return hooks.New(&hooks.Hooks{
+		Scripts:      scripts,
+		URL:          hook_url,
+		Timeout:      hook_timeout,
+		Mode:         mode,
+		Device:       device_name,
+		LocalAddress: laddr,
+	})
 }
 
-func simplify(addr string) string {
-	tokens := strings.Split(addr, "/")
-	return tokens[0]
+// new_session_id identifies a session in the logs of both ends
+func new_session_id() string {
+	buffer := make([]byte, 4)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
 }
 
-func setup_server_transport(ctx context.Context, certName string) (transport.Transport, error) {
-	config := transport.QuicConfig{
+func parse_mss_clamp(value string) int {
+	if value == "" {
+		return 0
+	}
+	if value == "auto" {
+		return piper.MSS_CLAMP_AUTO
+	}
+	result, _ := strconv.Atoi(value)
+	return result
+}
+
+func server_config(session string) transport.QuicConfig {
+	return transport.QuicConfig{
 		CertFile: "server.pem",
 		KeyFile:  "server.key",
 		CAFile:   "ca.pem",
+		Session:  session,
+		Mark:     fwmark,
 	}
-	ss, err := transport.NewQuicServerTransport(config, bind_string, ctx, certName)
-	return ss, err
 }
 
-func setup_client_transport(ctx context.Context, certName string) (transport.Transport, error) {
-	config := transport.QuicConfig{
+func setup_server_transport(ctx context.Context, certName string, session string) (transport.Transport, error) {
+	return listener.Accept(server_config(session), ctx, certName)
+}
+
+func client_config(session string) transport.QuicConfig {
+	return transport.QuicConfig{
 		CertFile: "client.pem",
 		KeyFile:  "client.key",
 		CAFile:   "ca.pem",
+		Streams:  streams,
+		Session:  session,
+		Mark:     fwmark,
+	}
+}
+
+// setup_client_transport connects to the first server endpoint that answers
+func setup_client_transport(ctx context.Context, certName string, session string) (transport.Transport, transport.Endpoint, error) {
+	config := client_config(session)
+	candidates, err := endpoints.Candidates(ctx)
+	if err != nil {
+		return nil, transport.Endpoint{}, transport.NewHandshakeError(transport.REASON_CONNECT, err)
+	}
+	var errs []error
+	for _, endpoint := range candidates {
+		connect_context, cancel := context.WithTimeout(ctx, connect_timeout)
+		trans, err := transport.NewQuicClientTransport(config, endpoint, connect_context, certName)
+		cancel()
+		if err == nil {
+			endpoints.Succeeded(endpoint)
+			return trans, endpoint, nil
+		}
+		logger.Warn("Server endpoint failed", "session", session, "endpoint", endpoint, "error", err)
+		endpoints.Failed(endpoint)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, transport.Endpoint{}, errors.Join(errs...)
+}
+
+// run_failback probes the servers preferred over endpoint every -failback and ends the session
+// (see cancel) as soon as one of them answers, the next session connects to it
+func run_failback(ctx context.Context, cancel context.CancelCauseFunc, config transport.QuicConfig, endpoint transport.Endpoint) {
+	ticker := time.NewTicker(failback)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, preferred := range endpoints.Preferred(ctx, endpoint) {
+			probe_context, cancel_probe := context.WithTimeout(ctx, connect_timeout)
+			err := config.Probe(probe_context, preferred)
+			cancel_probe()
+			if err == nil {
+				logger.Info("Preferred server is back, failing back", "session", config.Session, "endpoint", preferred)
+				endpoints.Succeeded(preferred)
+				cancel(transport.NewShutdown(transport.FAILBACK))
+				return
+			}
+			logger.Debug("Preferred server still down", "session", config.Session, "endpoint", preferred, "error", err)
+		}
 	}
-	return transport.NewQuicClientTransport(config, server_address, ctx, certName)
 }
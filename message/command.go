@@ -1,6 +1,10 @@
 package message
 
-import "errors"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
 
 type Command struct {
 	Type   CMD_TYPE
@@ -20,6 +24,80 @@ func OK() Command {
 	return result
 }
 
+func (v Command) IsEcho() bool {
+	return v.Type == CMD_ECHO
+}
+
+func (v Command) IsEchoReply() bool {
+	return v.Type == CMD_ECHO_REPLY
+}
+
+// Echo builds a keepalive probe carrying the sequence number
+func Echo(seq uint64) Command {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, seq)
+	result, _ := WrapCommand(CMD_ECHO, data)
+	return result
+}
+
+// EchoReply answers a probe by returning its payload unchanged
+func EchoReply(echo Command) Command {
+	result, _ := WrapCommand(CMD_ECHO_REPLY, echo.Data)
+	return result
+}
+
+// Sequence returns the sequence number of an echo or echo reply
+func (v Command) Sequence() (uint64, error) {
+	if len(v.Data) != 8 {
+		return 0, errors.New("invalid echo payload")
+	}
+	return binary.BigEndian.Uint64(v.Data), nil
+}
+
+// MTU carries a tunnel MTU proposal (request) or the agreed value (reply)
+func MTU(mtu int) Command {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(mtu))
+	result, _ := WrapCommand(CMD_MTU, data)
+	return result
+}
+
+// MTUValue returns the MTU carried by a CMD_MTU command
+func (v Command) MTUValue() (int, error) {
+	if len(v.Data) != 2 {
+		return 0, errors.New("invalid mtu payload")
+	}
+	return int(binary.BigEndian.Uint16(v.Data)), nil
+}
+
+// Goodbye announces the sender is ending the session and why. The peer answers with a Goodbye too
+func Goodbye(reason string) Command {
+	result, _ := WrapCommand(CMD_GOODBYE, []byte(reason))
+	return result
+}
+
+func (v Command) IsGoodbye() bool {
+	return v.Type == CMD_GOODBYE
+}
+
+// Address carries the tunnel address (CIDR) the server assigns to the client. Empty keeps the address of the client
+func Address(cidr string) Command {
+	result, _ := WrapCommand(CMD_ADDRESS, []byte(cidr))
+	return result
+}
+
+// Push carries the configuration the server pushes to the client, besides the routes and the address
+func Push(config string) Command {
+	result, _ := WrapCommand(CMD_PUSH, []byte(config))
+	return result
+}
+
+// Forward asks the peer to listen for a port forwarded back to this side, see piper.Forward
+func Forward(forward string) Command {
+	result, _ := WrapCommand(CMD_FORWARD, []byte(forward))
+	return result
+}
+
 func FAIL() Command {
 	result, _ := WrapCommand(CMD_FAIL, []byte{})
 	return result
@@ -28,9 +106,36 @@ func FAIL() Command {
 type CMD_TYPE byte
 
 const CMD_SUBNET_UPDATE CMD_TYPE = 0x01
+const CMD_ECHO CMD_TYPE = 0x02
+const CMD_ECHO_REPLY CMD_TYPE = 0x03
+const CMD_MTU CMD_TYPE = 0x04
+const CMD_GOODBYE CMD_TYPE = 0x05
+const CMD_ADDRESS CMD_TYPE = 0x06
+const CMD_PUSH CMD_TYPE = 0x07
+const CMD_FORWARD CMD_TYPE = 0x08
 const CMD_OK CMD_TYPE = 0x00
 const CMD_FAIL CMD_TYPE = 0xf0
 
+var CMD_NAMES = map[CMD_TYPE]string{
+	CMD_OK:            "OK",
+	CMD_FAIL:          "FAIL",
+	CMD_SUBNET_UPDATE: "SUBNET_UPDATE",
+	CMD_ECHO:          "ECHO",
+	CMD_ECHO_REPLY:    "ECHO_REPLY",
+	CMD_MTU:           "MTU",
+	CMD_GOODBYE:       "GOODBYE",
+	CMD_ADDRESS:       "ADDRESS",
+	CMD_PUSH:          "PUSH",
+	CMD_FORWARD:       "FORWARD",
+}
+
+func (v CMD_TYPE) String() string {
+	if name, ok := CMD_NAMES[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_%d", byte(v))
+}
+
 func WrapCommand(cmdType CMD_TYPE, data []byte) (Command, error) {
 	length := len(data)
 	if length > 0xffff {
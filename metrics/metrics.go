@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/stats"
+	"github.com/wushilin/go-vpn/transport"
+)
+
+// Returns the transports of the running sessions, empty between sessions
+type TransportProvider func() []transport.Transport
+
+// writer renders metrics in the Prometheus text exposition format
+type writer struct {
+	out *bufio.Writer
+}
+
+func (v writer) header(name, kind, help string) {
+	fmt.Fprintf(v.out, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(v.out, "# TYPE %s %s\n", name, kind)
+}
+
+func (v writer) value(name string, value any, labels ...string) {
+	v.out.WriteString(name)
+	if len(labels) > 0 {
+		v.out.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				v.out.WriteString(",")
+			}
+			fmt.Fprintf(v.out, "%s=\"%s\"", labels[i], escape(labels[i+1]))
+		}
+		v.out.WriteString("}")
+	}
+	fmt.Fprintf(v.out, " %v\n", value)
+}
+
+func (v writer) single(name, kind, help string, value any) {
+	v.header(name, kind, help)
+	v.value(name, value)
+}
+
+// labeled writes one sample per entry of the map, the key split by `:` into the label values
+func (v writer) labeled(name, kind, help string, values map[string]uint64, label_names ...string) {
+	v.header(name, kind, help)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		label_values := strings.SplitN(key, ":", len(label_names))
+		labels := make([]string, 0, 2*len(label_names))
+		for i, label := range label_names {
+			label_value := ""
+			if i < len(label_values) {
+				label_value = label_values[i]
+			}
+			labels = append(labels, label, label_value)
+		}
+		v.value(name, values[key], labels...)
+	}
+}
+
+func escape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func write_metrics(out *bufio.Writer, s *stats.GlobalStats, current TransportProvider) {
+	w := writer{out: out}
+	w.single("govpn_sent_bytes_total", "counter", "Bytes sent into the tunnel", s.UploadedBytes())
+	w.single("govpn_received_bytes_total", "counter", "Bytes received from the tunnel", s.DownloadedBytes())
+	w.single("govpn_sent_packets_total", "counter", "Packets sent into the tunnel", s.UploadedPackets())
+	w.single("govpn_received_packets_total", "counter", "Packets received from the tunnel", s.DownloadedPackets())
+	w.labeled("govpn_dropped_packets_total", "counter", "Packets dropped by reason", s.DroppedByReason(), "reason")
+	w.labeled("govpn_errors_total", "counter", "I/O errors by kind", s.Errors(), "kind")
+	w.single("govpn_reconnects_total", "counter", "Sessions ended and restarted", s.ReconnectedCount())
+	w.single("govpn_reconnect_backoff_seconds", "gauge", "Wait before the next reconnect, 0 after a healthy session", s.BackoffDelay().Seconds())
+	w.single("govpn_reconnect_failed_attempts", "gauge", "Reconnect failures in a row", s.BackoffAttempts())
+	w.single("govpn_routes_installed", "gauge", "Routes installed for the peer", s.Routes())
+	w.single("govpn_rtt_seconds", "gauge", "Last round trip time of the ECHO probes", s.RTT().Seconds())
+	w.single("govpn_jitter_seconds", "gauge", "Jitter of the ECHO probes round trip time", s.Jitter().Seconds())
+	w.single("govpn_echo_sent_total", "counter", "ECHO probes sent", s.EchoSent())
+	w.single("govpn_echo_lost_total", "counter", "ECHO probes not answered in time", s.EchoLost())
+	w.labeled("govpn_handshake_failures_total", "counter", "Failed session setups by reason", s.HandshakeFailures(), "reason")
+	w.labeled("govpn_control_commands_total", "counter", "Control commands by direction and type", s.ControlCommands(), "direction", "command")
+	w.labeled("govpn_filter_rule_hits_total", "counter", "Packets matched by each filter rule", s.RuleHits(), "rule")
+
+	peers := s.Peers()
+	names := make([]string, 0, len(peers))
+	for name := range peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.header("govpn_peer_sent_bytes_total", "counter", "Bytes sent to the peer")
+	for _, name := range names {
+		w.value("govpn_peer_sent_bytes_total", peers[name].UploadedBytes(), "peer", name)
+	}
+	w.header("govpn_peer_received_bytes_total", "counter", "Bytes received from the peer")
+	for _, name := range names {
+		w.value("govpn_peer_received_bytes_total", peers[name].DownloadedBytes(), "peer", name)
+	}
+	w.header("govpn_peer_sent_packets_total", "counter", "Packets sent to the peer")
+	for _, name := range names {
+		w.value("govpn_peer_sent_packets_total", peers[name].UploadedPackets(), "peer", name)
+	}
+	w.header("govpn_peer_received_packets_total", "counter", "Packets received from the peer")
+	for _, name := range names {
+		w.value("govpn_peer_received_packets_total", peers[name].DownloadedPackets(), "peer", name)
+	}
+
+	transports := current()
+	if len(transports) > 0 {
+		var pool transport.PoolStats
+		for _, trans := range transports {
+			next := trans.GetPoolStats()
+			pool.Borrowed += next.Borrowed
+			pool.Returned += next.Returned
+			pool.Created += next.Created
+			pool.Destroyed += next.Destroyed
+		}
+		w.single("govpn_buffer_pool_borrowed_total", "counter", "Packet buffers borrowed from the pools of the current sessions", pool.Borrowed)
+		w.single("govpn_buffer_pool_returned_total", "counter", "Packet buffers returned to the pools of the current sessions", pool.Returned)
+		w.single("govpn_buffer_pool_created_total", "counter", "Packet buffers created by the pools of the current sessions", pool.Created)
+		w.single("govpn_buffer_pool_destroyed_total", "counter", "Packet buffers destroyed by the pools of the current sessions", pool.Destroyed)
+		w.single("govpn_buffer_pool_in_use", "gauge", "Packet buffers currently borrowed", pool.Borrowed-pool.Returned)
+	}
+	w.single("govpn_connected", "gauge", "Sessions established, 0 or 1 on a client", len(transports))
+}
+
+func Handler(s *stats.GlobalStats, current TransportProvider) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		out := bufio.NewWriter(resp)
+		write_metrics(out, s, current)
+		out.Flush()
+	})
+}
+
+// Serve exposes the metrics on http://<addr>/metrics until the listener fails
+func Serve(addr string, s *stats.GlobalStats, current TransportProvider) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(s, current))
+	logging.For(logging.MAIN).Info("Metrics listening", "url", fmt.Sprintf("http://%s/metrics", addr))
+	return http.ListenAndServe(addr, mux)
+}
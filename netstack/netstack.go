@@ -0,0 +1,260 @@
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// Name of the device in the logs
+const NAME = "netstack"
+
+const NIC tcpip.NICID = 1
+
+// Packets the stack sent that Read didn't pick up yet, more are dropped
+const QUEUE = 1024
+
+// Port of the DNS servers set with SetDNS
+const DNS_PORT = 53
+
+// Stack is a TCP/IP stack in userspace. Its packets are read and written like the ones of a TUN device, Dial connects
+// through it. Nothing on the host changes, no privileges are needed
+type Stack struct {
+	stack    *stack.Stack
+	endpoint *channel.Endpoint
+	mutex    sync.Mutex
+	address  netip.Prefix
+	dns      []netip.Addr
+	deadline time.Time
+}
+
+// New creates a stack with the mtu, sending everything it dials out of the device
+func New(mtu int) (*Stack, error) {
+	result := &Stack{
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+		}),
+		endpoint: channel.New(QUEUE, uint32(mtu), ""),
+	}
+	if err := result.stack.CreateNIC(NIC, result.endpoint); err != nil {
+		result.Close()
+		return nil, fmt.Errorf("unable to create nic: %s", err)
+	}
+	result.stack.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: NIC},
+		{Destination: header.IPv6EmptySubnet, NIC: NIC},
+	})
+	return result, nil
+}
+
+func (v *Stack) Name() string {
+	return NAME
+}
+
+// SetReadDeadline applies to the next Reads, like on a file
+func (v *Stack) SetReadDeadline(t time.Time) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.deadline = t
+	return nil
+}
+
+// Read returns the next packet the stack sends
+func (v *Stack) Read(buffer []byte) (int, error) {
+	v.mutex.Lock()
+	deadline := v.deadline
+	v.mutex.Unlock()
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	packet := v.endpoint.ReadContext(ctx)
+	if packet == nil {
+		if ctx.Err() != nil {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return 0, os.ErrClosed
+	}
+	defer packet.DecRef()
+	view := packet.ToView()
+	defer view.Release()
+	return copy(buffer, view.AsSlice()), nil
+}
+
+// Write hands a packet received from the tunnel to the stack
+func (v *Stack) Write(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, nil
+	}
+	var protocol tcpip.NetworkProtocolNumber
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		protocol = ipv4.ProtocolNumber
+	case header.IPv6Version:
+		protocol = ipv6.ProtocolNumber
+	default:
+		// not for us, like a TUN device would
+		return len(packet), nil
+	}
+	buffer := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
+	v.endpoint.InjectInbound(protocol, buffer)
+	buffer.DecRef()
+	return len(packet), nil
+}
+
+func (v *Stack) Close() error {
+	v.endpoint.Close()
+	v.stack.Close()
+	v.stack.Wait()
+	return nil
+}
+
+// SetAddress replaces the address of the stack, a CIDR like 10.54.0.11/24
+func (v *Stack) SetAddress(cidr string) error {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.address == prefix {
+		return nil
+	}
+	if v.address.IsValid() {
+		v.stack.RemoveAddress(NIC, tcpip.AddrFromSlice(v.address.Addr().AsSlice()))
+	}
+	address := tcpip.ProtocolAddress{
+		Protocol: protocol_of(prefix.Addr()),
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFromSlice(prefix.Addr().AsSlice()),
+			PrefixLen: prefix.Bits(),
+		},
+	}
+	if err := v.stack.AddProtocolAddress(NIC, address, stack.AddressProperties{}); err != nil {
+		v.address = netip.Prefix{}
+		return fmt.Errorf("unable to set address %s: %s", cidr, err)
+	}
+	v.address = prefix
+	return nil
+}
+
+func (v *Stack) SetMTU(mtu int) error {
+	v.endpoint.SetMTU(uint32(mtu))
+	return nil
+}
+
+// SetDNS makes Dial resolve names with servers through the stack, instead of the resolver of the host.
+// Invalid addresses are skipped
+func (v *Stack) SetDNS(servers []string) {
+	var dns []netip.Addr
+	for _, server := range servers {
+		if address, err := netip.ParseAddr(server); err == nil {
+			dns = append(dns, address.Unmap())
+		}
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.dns = dns
+}
+
+// Dial connects to address (host:port) through the stack, network is tcp or udp
+func (v *Stack) Dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port_string, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(port_string, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", port_string)
+	}
+	addresses, err := v.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var last error
+	for _, next := range addresses {
+		conn, err := v.dial(ctx, network, netip.AddrPortFrom(next, uint16(port)))
+		if err == nil {
+			return conn, nil
+		}
+		last = err
+	}
+	return nil, last
+}
+
+func (v *Stack) dial(ctx context.Context, network string, address netip.AddrPort) (net.Conn, error) {
+	target := tcpip.FullAddress{
+		NIC:  NIC,
+		Addr: tcpip.AddrFromSlice(address.Addr().AsSlice()),
+		Port: address.Port(),
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return gonet.DialContextTCP(ctx, v.stack, target, protocol_of(address.Addr()))
+	case "udp", "udp4", "udp6":
+		return gonet.DialUDP(v.stack, nil, &target, protocol_of(address.Addr()))
+	}
+	return nil, fmt.Errorf("unsupported network %s", network)
+}
+
+// resolve looks host up with the servers of SetDNS, or the resolver of the host without them
+func (v *Stack) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if address, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{address.Unmap()}, nil
+	}
+	v.mutex.Lock()
+	dns := v.dns
+	v.mutex.Unlock()
+	resolver := net.DefaultResolver
+	if len(dns) > 0 {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				var last error
+				for _, server := range dns {
+					conn, err := v.dial(ctx, network, netip.AddrPortFrom(server, DNS_PORT))
+					if err == nil {
+						return conn, nil
+					}
+					last = err
+				}
+				return nil, last
+			},
+		}
+	}
+	addresses, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for i := range addresses {
+		addresses[i] = addresses[i].Unmap()
+	}
+	return addresses, nil
+}
+
+func protocol_of(address netip.Addr) tcpip.NetworkProtocolNumber {
+	if address.Unmap().Is4() {
+		return ipv4.ProtocolNumber
+	}
+	return ipv6.ProtocolNumber
+}
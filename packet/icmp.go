@@ -0,0 +1,88 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const ICMPV4_DEST_UNREACHABLE = 3
+const ICMPV4_FRAG_NEEDED = 4
+const ICMPV6_PACKET_TOO_BIG = 2
+
+// RFC 1812: ICMP errors carry as much of the original as fits in 576 bytes
+const ICMPV4_MAX_ERROR = 576
+
+// RFC 4443: ICMPv6 errors must not exceed the minimum IPv6 MTU
+const ICMPV6_MAX_ERROR = 1280
+
+var ErrNoICMP = errors.New("packet can't be answered with ICMP")
+
+// TooBig synthesises an ICMPv4 Fragmentation Needed or ICMPv6 Packet Too Big in response
+// to original, advertising mtu. The reply appears to come from the original destination
+func TooBig(original []byte, h Header, mtu int) ([]byte, error) {
+	if is_icmp_error(h) {
+		return nil, ErrNoICMP
+	}
+	if h.Version == 4 {
+		// only packets with Don't Fragment set expect Fragmentation Needed
+		if binary.BigEndian.Uint16(original[6:8])&0x4000 == 0 {
+			return nil, ErrNoICMP
+		}
+		quoted := original[:min(len(original), ICMPV4_MAX_ERROR-IPV4_HEADER_LEN-8)]
+		result := make([]byte, IPV4_HEADER_LEN+8+len(quoted))
+		write_ipv4_header(result, h.Dst.AsSlice(), h.Src.AsSlice(), PROTO_ICMP)
+		icmp := result[IPV4_HEADER_LEN:]
+		icmp[0] = ICMPV4_DEST_UNREACHABLE
+		icmp[1] = ICMPV4_FRAG_NEEDED
+		binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+		copy(icmp[8:], quoted)
+		binary.BigEndian.PutUint16(icmp[2:4], Fold(Sum(icmp, 0)))
+		return result, nil
+	}
+	quoted := original[:min(len(original), ICMPV6_MAX_ERROR-IPV6_HEADER_LEN-8)]
+	result := make([]byte, IPV6_HEADER_LEN+8+len(quoted))
+	write_ipv6_header(result, h.Dst.AsSlice(), h.Src.AsSlice(), PROTO_ICMPV6)
+	icmp := result[IPV6_HEADER_LEN:]
+	icmp[0] = ICMPV6_PACKET_TOO_BIG
+	binary.BigEndian.PutUint32(icmp[4:8], uint32(mtu))
+	copy(icmp[8:], quoted)
+	reply, _ := Parse(result)
+	UpdateL4Checksum(result, reply, 2)
+	return result, nil
+}
+
+// is_icmp_error is true for ICMP error messages, which must never trigger another ICMP error
+func is_icmp_error(h Header) bool {
+	if h.Fragment {
+		return false
+	}
+	switch h.Protocol {
+	case PROTO_ICMP:
+		switch h.SrcPort {
+		case 3, 4, 5, 11, 12:
+			return true
+		}
+	case PROTO_ICMPV6:
+		return h.SrcPort < 128
+	}
+	return false
+}
+
+func write_ipv4_header(data []byte, src, dst []byte, protocol byte) {
+	data[0] = 0x45
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	data[8] = 64
+	data[9] = protocol
+	copy(data[12:16], src)
+	copy(data[16:20], dst)
+	binary.BigEndian.PutUint16(data[10:12], Fold(Sum(data[:IPV4_HEADER_LEN], 0)))
+}
+
+func write_ipv6_header(data []byte, src, dst []byte, next_header byte) {
+	data[0] = 0x60
+	binary.BigEndian.PutUint16(data[4:6], uint16(len(data)-IPV6_HEADER_LEN))
+	data[6] = next_header
+	data[7] = 64
+	copy(data[8:24], src)
+	copy(data[24:40], dst)
+}
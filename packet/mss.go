@@ -0,0 +1,61 @@
+package packet
+
+import "encoding/binary"
+
+const TCP_FLAG_SYN = 0x02
+const TCP_OPTION_END = 0
+const TCP_OPTION_NOP = 1
+const TCP_OPTION_MSS = 2
+
+// MSSForMTU is the largest TCP segment fitting in mtu for the IP version
+func MSSForMTU(mtu int, version int) int {
+	if version == 6 {
+		return mtu - IPV6_HEADER_LEN - TCP_HEADER_LEN
+	}
+	return mtu - IPV4_HEADER_LEN - TCP_HEADER_LEN
+}
+
+// ClampMSS lowers the MSS option of a TCP SYN or SYN-ACK to at most mss and fixes the checksum.
+// It returns true when the packet was modified
+func ClampMSS(data []byte, h Header, mss int) bool {
+	if h.Protocol != PROTO_TCP || h.Fragment || h.L4Offset < 0 || h.L4Offset > len(data) {
+		return false
+	}
+	tcp := data[h.L4Offset:]
+	if len(tcp) < TCP_HEADER_LEN || tcp[13]&TCP_FLAG_SYN == 0 {
+		return false
+	}
+	data_offset := int(tcp[12]>>4) * 4
+	if data_offset < TCP_HEADER_LEN || len(tcp) < data_offset {
+		return false
+	}
+	options := tcp[TCP_HEADER_LEN:data_offset]
+	for i := 0; i < len(options); {
+		kind := options[i]
+		if kind == TCP_OPTION_END {
+			break
+		}
+		if kind == TCP_OPTION_NOP {
+			i++
+			continue
+		}
+		if i+1 >= len(options) {
+			break
+		}
+		length := int(options[i+1])
+		if length < 2 || i+length > len(options) {
+			break
+		}
+		if kind == TCP_OPTION_MSS && length == 4 {
+			current := int(binary.BigEndian.Uint16(options[i+2 : i+4]))
+			if current <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(options[i+2:i+4], uint16(mss))
+			UpdateL4Checksum(data, h, 16)
+			return true
+		}
+		i += length
+	}
+	return false
+}
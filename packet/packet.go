@@ -0,0 +1,194 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"net/netip"
+)
+
+const PROTO_ICMP byte = 1
+const PROTO_TCP byte = 6
+const PROTO_UDP byte = 17
+const PROTO_ICMPV6 byte = 58
+
+const IPV4_HEADER_LEN = 20
+const IPV6_HEADER_LEN = 40
+const TCP_HEADER_LEN = 20
+
+// Header is the part of an IP packet go-vpn cares about
+type Header struct {
+	Version  int
+	Src      netip.Addr
+	Dst      netip.Addr
+	Protocol byte
+	// Offset of the transport (TCP/UDP/ICMP) header
+	L4Offset int
+	// True when the packet is a fragment that doesn't carry the transport header
+	Fragment bool
+	// True for any fragment of a fragmented packet, including the first one
+	Fragmented bool
+	SrcPort    uint16
+	DstPort    uint16
+}
+
+var ErrTruncated = errors.New("truncated packet")
+var ErrVersion = errors.New("not an IPv4 or IPv6 packet")
+
+// Parse decodes the IP header and the ports (or ICMP type/code as SrcPort/DstPort) of the packet
+func Parse(data []byte) (Header, error) {
+	if len(data) < 1 {
+		return Header{}, ErrTruncated
+	}
+	var result Header
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < IPV4_HEADER_LEN {
+			return Header{}, ErrTruncated
+		}
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < IPV4_HEADER_LEN || len(data) < ihl {
+			return Header{}, ErrTruncated
+		}
+		result.Version = 4
+		result.Src = netip.AddrFrom4([4]byte(data[12:16]))
+		result.Dst = netip.AddrFrom4([4]byte(data[16:20]))
+		result.Protocol = data[9]
+		result.L4Offset = ihl
+		flags := binary.BigEndian.Uint16(data[6:8])
+		result.Fragment = flags&0x1fff != 0
+		result.Fragmented = flags&0x3fff != 0
+	case 6:
+		if len(data) < IPV6_HEADER_LEN {
+			return Header{}, ErrTruncated
+		}
+		result.Version = 6
+		result.Src = netip.AddrFrom16([16]byte(data[8:24]))
+		result.Dst = netip.AddrFrom16([16]byte(data[24:40]))
+		next := data[6]
+		offset := IPV6_HEADER_LEN
+		for walking := true; walking; {
+			switch next {
+			case 0, 43, 60: // hop-by-hop, routing, destination options
+				if len(data) < offset+8 {
+					return Header{}, ErrTruncated
+				}
+				next = data[offset]
+				offset += (int(data[offset+1]) + 1) * 8
+				if offset > len(data) {
+					return Header{}, ErrTruncated
+				}
+			case 44: // fragment
+				if len(data) < offset+8 {
+					return Header{}, ErrTruncated
+				}
+				if binary.BigEndian.Uint16(data[offset+2:offset+4])&0xfff8 != 0 {
+					result.Fragment = true
+				}
+				result.Fragmented = true
+				next = data[offset]
+				offset += 8
+			case 51: // authentication header
+				if len(data) < offset+8 {
+					return Header{}, ErrTruncated
+				}
+				next = data[offset]
+				offset += (int(data[offset+1]) + 2) * 4
+				if offset > len(data) {
+					return Header{}, ErrTruncated
+				}
+			default:
+				walking = false
+			}
+		}
+		result.Protocol = next
+		result.L4Offset = offset
+	default:
+		return Header{}, ErrVersion
+	}
+	if result.Fragment {
+		return result, nil
+	}
+	l4 := data[min(result.L4Offset, len(data)):]
+	switch result.Protocol {
+	case PROTO_TCP, PROTO_UDP:
+		if len(l4) >= 4 {
+			result.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+			result.DstPort = binary.BigEndian.Uint16(l4[2:4])
+		}
+	case PROTO_ICMP, PROTO_ICMPV6:
+		if len(l4) >= 2 {
+			result.SrcPort = uint16(l4[0])
+			result.DstPort = uint16(l4[1])
+		}
+	}
+	return result, nil
+}
+
+// Sum adds data to a running internet checksum as 16 bits big endian words
+func Sum(data []byte, initial uint32) uint32 {
+	sum := initial
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+// Fold turns a running sum into the final one's complement checksum
+func Fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// PseudoHeaderSum is the checksum contribution of the IPv4/IPv6 pseudo header
+func PseudoHeaderSum(h Header, protocol byte, length int) uint32 {
+	src := h.Src.AsSlice()
+	dst := h.Dst.AsSlice()
+	sum := Sum(src, 0)
+	sum = Sum(dst, sum)
+	sum += uint32(protocol)
+	sum += uint32(length & 0xffff)
+	sum += uint32(length >> 16)
+	return sum
+}
+
+// UpdateL4Checksum recomputes the TCP/UDP/ICMPv6 checksum of the packet.
+// The checksum field is at checksum_offset from the transport header. A packet too short for it is left alone
+func UpdateL4Checksum(data []byte, h Header, checksum_offset int) {
+	if h.L4Offset < 0 || h.L4Offset+checksum_offset+2 > len(data) {
+		return
+	}
+	l4 := data[h.L4Offset:]
+	l4[checksum_offset] = 0
+	l4[checksum_offset+1] = 0
+	var sum uint32
+	if h.Protocol != PROTO_ICMP {
+		sum = PseudoHeaderSum(h, h.Protocol, len(l4))
+	}
+	sum = Sum(l4, sum)
+	binary.BigEndian.PutUint16(l4[checksum_offset:], Fold(sum))
+}
+
+// FlowHash hashes the 5-tuple of the packet so all packets of a flow get the same value.
+// Fragments only hash the addresses and protocol, the later fragments have no ports
+func FlowHash(data []byte) uint32 {
+	h, err := Parse(data)
+	if err != nil {
+		return 0
+	}
+	hash := fnv.New32a()
+	hash.Write(h.Src.AsSlice())
+	hash.Write(h.Dst.AsSlice())
+	if h.Fragmented {
+		hash.Write([]byte{h.Protocol})
+	} else {
+		hash.Write([]byte{h.Protocol, byte(h.SrcPort >> 8), byte(h.SrcPort), byte(h.DstPort >> 8), byte(h.DstPort)})
+	}
+	return hash.Sum32()
+}
@@ -0,0 +1,391 @@
+package piper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/packet"
+	"github.com/wushilin/go-vpn/transport"
+)
+
+// Packets waiting to be written by a capture. When the writer can't keep up, packets are
+// dropped from the capture, never from the tunnel
+const CAPTURE_QUEUE = 1024
+
+// Files kept by a capture limited in size: the one being written and the rotated ones
+const DEFAULT_CAPTURE_FILES = 2
+
+// pcapng block types and options, see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	pcapng_section_header        uint32 = 0x0a0d0d0a
+	pcapng_interface_description uint32 = 1
+	pcapng_enhanced_packet       uint32 = 6
+	pcapng_byte_order_magic      uint32 = 0x1a2b3c4d
+	pcapng_linktype_raw          uint16 = 101
+	pcapng_opt_comment           uint16 = 1
+	pcapng_opt_if_name           uint16 = 2
+	pcapng_opt_epb_flags         uint16 = 2
+	pcapng_flag_inbound          uint32 = 1
+	pcapng_flag_outbound         uint32 = 2
+)
+
+var ErrCaptureRunning = errors.New("capture to file already running")
+var ErrCaptureStopped = errors.New("no capture to file running")
+
+type captured struct {
+	time      time.Time
+	peer      string
+	direction DIRECTION
+	data      []byte
+}
+
+// Capture writes the packets crossing the tunnel (after the packet filter) in the pcapng format,
+// to a file and to any number of streams. It outlives the sessions: every Pipe records into the same Capture
+type Capture struct {
+	mutex sync.Mutex
+	file  *capture_sink
+	// copy of the running sinks, read by Record without locking
+	sinks atomic.Pointer[[]*capture_sink]
+}
+
+func NewCapture() *Capture {
+	return &Capture{}
+}
+
+// Record hands a copy of the packet to the running captures. Safe to call on a nil Capture
+func (v *Capture) Record(peer string, direction DIRECTION, data []byte) {
+	if v == nil {
+		return
+	}
+	sinks := v.sinks.Load()
+	if sinks == nil || len(*sinks) == 0 {
+		return
+	}
+	h, err := packet.Parse(data)
+	if err != nil {
+		return
+	}
+	var copied *captured
+	for _, sink := range *sinks {
+		if !sink.filter.Match(h, direction) {
+			continue
+		}
+		if copied == nil {
+			copied = &captured{time: time.Now(), peer: peer, direction: direction, data: append([]byte(nil), data...)}
+		}
+		select {
+		case sink.packets <- *copied:
+		default:
+			sink.dropped.Add(1)
+		}
+	}
+}
+
+// File returns the path and the filter of the capture to file, empty when not running
+func (v *Capture) File() (string, string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.file == nil {
+		return "", ""
+	}
+	return v.file.output.(*file_output).path, v.file.filter.Expression
+}
+
+// Start captures into path. max_size (bytes) limits the file size, 0 for no limit. When it is reached the file
+// is rotated to path.1, path.2... keeping files files in total, the oldest packets are lost first
+func (v *Capture) Start(path string, filter string, max_size int64, files int) error {
+	parsed, err := ParseCaptureFilter(filter)
+	if err != nil {
+		return err
+	}
+	if files < 1 {
+		files = DEFAULT_CAPTURE_FILES
+	}
+	output := &file_output{path: path, max_size: max_size, files: files}
+	if err := output.open(); err != nil {
+		return err
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.file != nil {
+		output.Close()
+		return ErrCaptureRunning
+	}
+	v.file = v.add(parsed, output)
+	logging.For(logging.PIPER).Info("Capture started", "file", path, "filter", parsed.Expression, "max_size", max_size, "files", files)
+	return nil
+}
+
+// Stop ends the capture to file
+func (v *Capture) Stop() error {
+	v.mutex.Lock()
+	sink := v.file
+	if sink != nil {
+		v.remove(sink)
+		v.file = nil
+	}
+	v.mutex.Unlock()
+	if sink == nil {
+		return ErrCaptureStopped
+	}
+	err := sink.stop()
+	logging.For(logging.PIPER).Info("Capture stopped", "file", sink.output.(*file_output).path, "dropped", sink.dropped.Load())
+	return err
+}
+
+// Stream writes the matching packets to out until done is closed or a write fails, e.g. the reader went away.
+// Nothing is written when the filter is invalid
+func (v *Capture) Stream(out io.Writer, filter string, done <-chan struct{}) error {
+	parsed, err := ParseCaptureFilter(filter)
+	if err != nil {
+		return err
+	}
+	// the header right away, so the reader (e.g. `wireshark -k -i -`) starts before the first packet
+	if _, err := out.Write(file_header()); err != nil {
+		return err
+	}
+	v.mutex.Lock()
+	sink := v.add(parsed, &stream_output{out: out})
+	v.mutex.Unlock()
+	logging.For(logging.PIPER).Info("Capture stream started", "filter", parsed.Expression)
+	select {
+	case <-done:
+	case <-sink.finished:
+	}
+	v.mutex.Lock()
+	v.remove(sink)
+	v.mutex.Unlock()
+	err = sink.stop()
+	logging.For(logging.PIPER).Info("Capture stream ended", "dropped", sink.dropped.Load())
+	return err
+}
+
+// add starts a sink. Called with the mutex held
+func (v *Capture) add(filter *CaptureFilter, output capture_output) *capture_sink {
+	sink := &capture_sink{
+		filter:   filter,
+		output:   output,
+		packets:  make(chan captured, CAPTURE_QUEUE),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go sink.run()
+	sinks := []*capture_sink{sink}
+	if current := v.sinks.Load(); current != nil {
+		sinks = append(sinks, *current...)
+	}
+	v.sinks.Store(&sinks)
+	return sink
+}
+
+// remove takes the sink out of Record. Called with the mutex held
+func (v *Capture) remove(sink *capture_sink) {
+	current := v.sinks.Load()
+	if current == nil {
+		return
+	}
+	sinks := make([]*capture_sink, 0, len(*current))
+	for _, next := range *current {
+		if next != sink {
+			sinks = append(sinks, next)
+		}
+	}
+	v.sinks.Store(&sinks)
+}
+
+type capture_sink struct {
+	filter   *CaptureFilter
+	output   capture_output
+	packets  chan captured
+	done     chan struct{}
+	finished chan struct{}
+	dropped  atomic.Uint64
+	err      error
+}
+
+func (v *capture_sink) run() {
+	defer close(v.finished)
+	for {
+		select {
+		case next := <-v.packets:
+			if err := v.output.write_block(enhanced_packet(next)); err != nil {
+				v.err = err
+				return
+			}
+		case <-v.done:
+			v.drain()
+			return
+		}
+	}
+}
+
+// drain writes what is still queued when the capture stops
+func (v *capture_sink) drain() {
+	for {
+		select {
+		case next := <-v.packets:
+			if err := v.output.write_block(enhanced_packet(next)); err != nil {
+				v.err = err
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// stop ends the writer and closes the output, returns the first write error
+func (v *capture_sink) stop() error {
+	close(v.done)
+	<-v.finished
+	return errors.Join(v.err, v.output.Close())
+}
+
+type capture_output interface {
+	// write_block writes one pcapng block
+	write_block(block []byte) error
+	Close() error
+}
+
+// stream_output writes to a stream, the headers are written by Stream
+type stream_output struct {
+	out io.Writer
+}
+
+func (v *stream_output) write_block(block []byte) error {
+	_, err := v.out.Write(block)
+	return err
+}
+
+func (v *stream_output) Close() error {
+	return nil
+}
+
+// file_output writes to a file, rotated when it would grow beyond max_size
+type file_output struct {
+	path     string
+	max_size int64
+	files    int
+	file     *os.File
+	size     int64
+}
+
+func (v *file_output) open() error {
+	file, err := os.OpenFile(v.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	header := file_header()
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return err
+	}
+	v.file = file
+	v.size = int64(len(header))
+	return nil
+}
+
+// rotate renames path.1 to path.2 and so on, path to path.1, then starts a new path
+func (v *file_output) rotate() error {
+	if err := v.file.Close(); err != nil {
+		return err
+	}
+	for i := v.files - 1; i >= 1; i-- {
+		from := v.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", v.path, i-1)
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", v.path, i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return v.open()
+}
+
+func (v *file_output) write_block(block []byte) error {
+	if v.max_size > 0 && v.size+int64(len(block)) > v.max_size && v.size > int64(len(file_header())) {
+		if err := v.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := v.file.Write(block)
+	v.size += int64(n)
+	return err
+}
+
+func (v *file_output) Close() error {
+	return v.file.Close()
+}
+
+// file_header is the section header and the description of the single interface, raw IP packets
+func file_header() []byte {
+	section := make([]byte, 16)
+	binary.LittleEndian.PutUint32(section[0:], pcapng_byte_order_magic)
+	binary.LittleEndian.PutUint16(section[4:], 1)
+	binary.LittleEndian.PutUint16(section[6:], 0)
+	// section length not specified
+	binary.LittleEndian.PutUint64(section[8:], 0xffffffffffffffff)
+
+	description := make([]byte, 8)
+	binary.LittleEndian.PutUint16(description[0:], pcapng_linktype_raw)
+	binary.LittleEndian.PutUint32(description[4:], transport.BUFFER_SIZE)
+	description = append_option(description, pcapng_opt_if_name, []byte("go-vpn"))
+	description = append_option(description, 0, nil)
+
+	return append(block(pcapng_section_header, section), block(pcapng_interface_description, description)...)
+}
+
+// enhanced_packet is the block of one packet, flagged inbound/outbound with the peer as comment
+func enhanced_packet(p captured) []byte {
+	micros := uint64(p.time.UnixMicro())
+	body := make([]byte, 20, 20+len(p.data)+32+len(p.peer))
+	binary.LittleEndian.PutUint32(body[0:], 0)
+	binary.LittleEndian.PutUint32(body[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(p.data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(p.data)))
+	body = append(body, p.data...)
+	body = append(body, make([]byte, padding(len(p.data)))...)
+
+	flags := make([]byte, 4)
+	if p.direction == IN {
+		binary.LittleEndian.PutUint32(flags, pcapng_flag_inbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, pcapng_flag_outbound)
+	}
+	body = append_option(body, pcapng_opt_epb_flags, flags)
+	if p.peer != "" {
+		body = append_option(body, pcapng_opt_comment, []byte(p.peer))
+	}
+	body = append_option(body, 0, nil)
+	return block(pcapng_enhanced_packet, body)
+}
+
+func padding(length int) int {
+	return (4 - length%4) % 4
+}
+
+// append_option appends a padded option, code 0 is the end of the options
+func append_option(body []byte, code uint16, value []byte) []byte {
+	body = binary.LittleEndian.AppendUint16(body, code)
+	body = binary.LittleEndian.AppendUint16(body, uint16(len(value)))
+	body = append(body, value...)
+	return append(body, make([]byte, padding(len(value)))...)
+}
+
+// block wraps a body padded to 32 bits with the block type and the total length, repeated at the end
+func block(kind uint32, body []byte) []byte {
+	length := uint32(12 + len(body))
+	result := make([]byte, 0, length)
+	result = binary.LittleEndian.AppendUint32(result, kind)
+	result = binary.LittleEndian.AppendUint32(result, length)
+	result = append(result, body...)
+	return binary.LittleEndian.AppendUint32(result, length)
+}
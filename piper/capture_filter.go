@@ -0,0 +1,229 @@
+package piper
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wushilin/go-vpn/packet"
+)
+
+// CaptureFilter selects the packets written by a capture, a small subset of the tcpdump syntax:
+//
+//	in | out                            direction relative to the local host
+//	ip | ip6                            address family
+//	tcp | udp | icmp | icmpv6           protocol, also `proto <name|number>`
+//	[src|dst] host <address>
+//	[src|dst] net <prefix>
+//	[src|dst] port <port|from-to>
+//
+// combined with `and` (or just a space), `or`, `not` and parentheses, e.g.
+// `out and tcp port 443` or `not (udp port 53 or icmp)`. An empty filter matches everything
+type CaptureFilter struct {
+	Expression string
+	match      matcher
+}
+
+func (v *CaptureFilter) Match(h packet.Header, direction DIRECTION) bool {
+	if v == nil || v.match == nil {
+		return true
+	}
+	return v.match(h, direction)
+}
+
+func ParseCaptureFilter(expression string) (*CaptureFilter, error) {
+	result := &CaptureFilter{Expression: strings.TrimSpace(expression)}
+	p := &filter_parser{tokens: tokenize(expression)}
+	if len(p.tokens) == 0 {
+		return result, nil
+	}
+	match, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected %s in capture filter", p.peek())
+	}
+	result.match = match
+	return result, nil
+}
+
+type matcher = func(h packet.Header, direction DIRECTION) bool
+
+func tokenize(expression string) []string {
+	expression = strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ").Replace(expression)
+	return strings.Fields(expression)
+}
+
+type filter_parser struct {
+	tokens []string
+	next   int
+}
+
+func (v *filter_parser) done() bool {
+	return v.next >= len(v.tokens)
+}
+
+func (v *filter_parser) peek() string {
+	if v.done() {
+		return ""
+	}
+	return v.tokens[v.next]
+}
+
+func (v *filter_parser) take() (string, error) {
+	if v.done() {
+		return "", fmt.Errorf("unexpected end of capture filter")
+	}
+	v.next++
+	return v.tokens[v.next-1], nil
+}
+
+// or := and { "or" and }
+func (v *filter_parser) or() (matcher, error) {
+	left, err := v.and()
+	if err != nil {
+		return nil, err
+	}
+	for v.peek() == "or" {
+		v.next++
+		right, err := v.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(h packet.Header, direction DIRECTION) bool {
+			return l(h, direction) || right(h, direction)
+		}
+	}
+	return left, nil
+}
+
+// and := not { ["and"] not }
+func (v *filter_parser) and() (matcher, error) {
+	left, err := v.not()
+	if err != nil {
+		return nil, err
+	}
+	for !v.done() && v.peek() != "or" && v.peek() != ")" {
+		if v.peek() == "and" {
+			v.next++
+		}
+		right, err := v.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(h packet.Header, direction DIRECTION) bool {
+			return l(h, direction) && right(h, direction)
+		}
+	}
+	return left, nil
+}
+
+// not := "not" not | "(" or ")" | primitive
+func (v *filter_parser) not() (matcher, error) {
+	token, err := v.take()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case "not":
+		inner, err := v.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(h packet.Header, direction DIRECTION) bool {
+			return !inner(h, direction)
+		}, nil
+	case "(":
+		inner, err := v.or()
+		if err != nil {
+			return nil, err
+		}
+		if closing, _ := v.take(); closing != ")" {
+			return nil, fmt.Errorf("missing ) in capture filter")
+		}
+		return inner, nil
+	}
+	return v.primitive(token)
+}
+
+func (v *filter_parser) primitive(token string) (matcher, error) {
+	switch token {
+	case "in", "inbound":
+		return direction_is(IN), nil
+	case "out", "outbound":
+		return direction_is(OUT), nil
+	case "ip", "ip4":
+		return func(h packet.Header, direction DIRECTION) bool { return h.Version == 4 }, nil
+	case "ip6":
+		return func(h packet.Header, direction DIRECTION) bool { return h.Version == 6 }, nil
+	case "tcp", "udp", "icmp", "icmpv6", "icmp6":
+		return protocol_is(strings.Replace(token, "icmp6", "icmpv6", 1))
+	case "proto":
+		value, err := v.take()
+		if err != nil {
+			return nil, err
+		}
+		return protocol_is(value)
+	}
+	src, dst := true, true
+	switch token {
+	case "src":
+		dst = false
+	case "dst":
+		src = false
+	}
+	if !src || !dst {
+		next, err := v.take()
+		if err != nil {
+			return nil, err
+		}
+		token = next
+	}
+	if token != "host" && token != "net" && token != "port" {
+		return nil, fmt.Errorf("unknown %s in capture filter", token)
+	}
+	value, err := v.take()
+	if err != nil {
+		return nil, err
+	}
+	if token == "port" {
+		ports, err := parse_port_range(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(h packet.Header, direction DIRECTION) bool {
+			if h.Fragment || (h.Protocol != packet.PROTO_TCP && h.Protocol != packet.PROTO_UDP) {
+				return false
+			}
+			return (src && ports.match(h.SrcPort)) || (dst && ports.match(h.DstPort))
+		}, nil
+	}
+	prefix, err := parse_prefix(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %s in capture filter", token, value)
+	}
+	if token == "host" && !prefix.IsSingleIP() {
+		return nil, fmt.Errorf("invalid host %s in capture filter, use net", value)
+	}
+	return func(h packet.Header, direction DIRECTION) bool {
+		return (src && prefix.Contains(h.Src)) || (dst && prefix.Contains(h.Dst))
+	}, nil
+}
+
+func direction_is(expected DIRECTION) matcher {
+	return func(h packet.Header, direction DIRECTION) bool {
+		return direction == expected
+	}
+}
+
+func protocol_is(value string) (matcher, error) {
+	protocol, err := parse_protocol(value)
+	if err != nil || protocol == ANY {
+		return nil, fmt.Errorf("invalid protocol %s in capture filter", value)
+	}
+	return func(h packet.Header, direction DIRECTION) bool {
+		return int(h.Protocol) == protocol
+	}, nil
+}
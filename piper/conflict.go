@@ -0,0 +1,155 @@
+package piper
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/wushilin/go-vpn/common"
+	"github.com/wushilin/go-vpn/logging"
+)
+
+// How a route requested by the peer relates to the routes of the host
+const CONFLICT_NEW = "new"
+
+// The routing table already has the same prefix, on another device
+const CONFLICT_DUPLICATE = "duplicate"
+
+// The routing table has a route containing the prefix or contained in it
+const CONFLICT_OVERLAPPING = "overlapping"
+
+// The prefix is within a network connected to a local interface, installing it cuts the host off that network
+const CONFLICT_LOCAL = "local"
+
+// What is done with a conflicting route
+const CONFLICT_SKIP = "skip"
+
+// Installed anyway, a duplicate takes over the existing route until the session ends, then the route is restored
+const CONFLICT_REPLACE = "replace"
+
+// The route is refused, which fails the route setup of the session
+const CONFLICT_FAIL = "fail"
+
+// ConflictPolicy tells what is done per conflict class
+type ConflictPolicy map[string]string
+
+var DEFAULT_CONFLICT_POLICY = ConflictPolicy{
+	CONFLICT_DUPLICATE:   CONFLICT_SKIP,
+	CONFLICT_OVERLAPPING: CONFLICT_REPLACE,
+	CONFLICT_LOCAL:       CONFLICT_SKIP,
+}
+
+// Returned by AddRoute when the policy skips the route. The session goes on without it
+var ErrRouteSkipped = errors.New("route skipped")
+
+// ParseConflictPolicy reads `class=action,...` over the defaults, e.g. `local=fail,duplicate=replace`
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	result := make(ConflictPolicy)
+	for class, action := range DEFAULT_CONFLICT_POLICY {
+		result[class] = action
+	}
+	for _, next := range common.ToList(value) {
+		class, action, _ := strings.Cut(next, "=")
+		if _, ok := DEFAULT_CONFLICT_POLICY[class]; !ok {
+			return nil, fmt.Errorf("invalid conflict class %s, expect %s, %s or %s", class, CONFLICT_DUPLICATE, CONFLICT_OVERLAPPING, CONFLICT_LOCAL)
+		}
+		if action != CONFLICT_SKIP && action != CONFLICT_REPLACE && action != CONFLICT_FAIL {
+			return nil, fmt.Errorf("invalid action %s for %s, expect %s, %s or %s", action, class, CONFLICT_SKIP, CONFLICT_REPLACE, CONFLICT_FAIL)
+		}
+		result[class] = action
+	}
+	return result, nil
+}
+
+// action for class, the default when the policy doesn't tell
+func (v ConflictPolicy) action(class string) string {
+	if action, ok := v[class]; ok {
+		return action
+	}
+	return DEFAULT_CONFLICT_POLICY[class]
+}
+
+// classify_route compares cidr with the routes of the host, returns its class and the route it conflicts with.
+// Routes of the TUN device belong to go-vpn and never conflict
+func (v *Pipe) classify_route(cidr string) (string, *common.KernelRoute, error) {
+	prefix, err := parse_route(cidr)
+	if err != nil {
+		return "", nil, err
+	}
+	device := v.Iface.Name()
+	ipv6 := prefix.Addr().Is6()
+	// connected networks are in the main table, whatever the table of the tunnel
+	connected, err := common.ShowRoutes("main", ipv6)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, route := range connected {
+		if route.Connected && route.Device != device && route.Prefix.Bits() <= prefix.Bits() && route.Prefix.Contains(prefix.Addr()) {
+			return CONFLICT_LOCAL, &route, nil
+		}
+	}
+	routes := connected
+	if common.RouteTable != "" && common.RouteTable != "main" {
+		if routes, err = common.ShowRoutes(common.RouteTable, ipv6); err != nil {
+			return "", nil, err
+		}
+	}
+	for _, route := range routes {
+		if route.Device != device && route.Prefix.Masked() == prefix {
+			return CONFLICT_DUPLICATE, &route, nil
+		}
+	}
+	for _, route := range routes {
+		// the default route overlaps everything
+		if route.Device == device || route.Prefix.Bits() == 0 {
+			continue
+		}
+		if route.Prefix.Overlaps(prefix) {
+			return CONFLICT_OVERLAPPING, &route, nil
+		}
+	}
+	return CONFLICT_NEW, nil, nil
+}
+
+// check_conflict applies the conflict policy to cidr. replaced is the duplicate the route must replace, nil
+// when the route is added next to the others
+func (v *Pipe) check_conflict(cidr string) (replaced *common.KernelRoute, err error) {
+	class, existing, err := v.classify_route(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if class == CONFLICT_NEW {
+		return nil, nil
+	}
+	action := v.Conflicts.action(class)
+	logger := v.logger(logging.ROUTES).With("route", cidr, "conflict", class, "existing", existing.String(), "action", action)
+	switch action {
+	case CONFLICT_SKIP:
+		logger.Warn("Route conflicts with the host, skipped")
+		return nil, fmt.Errorf("%w, %s with %s", ErrRouteSkipped, class, existing)
+	case CONFLICT_FAIL:
+		logger.Error("Route conflicts with the host, refused")
+		return nil, fmt.Errorf("route %s is %s with %s", cidr, class, existing)
+	}
+	logger.Warn("Route conflicts with the host, installed anyway")
+	if class == CONFLICT_DUPLICATE {
+		return existing, nil
+	}
+	return nil, nil
+}
+
+// restore_route adds back the route of the host a route of the session replaced, unless it is there again
+func (v *Pipe) restore_route(cidr string, replaced common.KernelRoute) {
+	logger := v.logger(logging.ROUTES).With("route", cidr, "restored", replaced.String())
+	if present, err := common.HasRoute(replaced); err != nil {
+		logger.Warn("Unable to list the routes, not restoring", "error", err)
+		return
+	} else if present {
+		return
+	}
+	if !common.RestoreRoute(replaced) {
+		logger.Error("Unable to restore the replaced route")
+		return
+	}
+	logger.Info("Restored the replaced route")
+}
@@ -0,0 +1,54 @@
+package piper
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/songgao/water"
+)
+
+// Device carries the IP packets of the pipe: a TUN device, or a userspace network stack in rootless mode
+type Device interface {
+	io.ReadWriteCloser
+	// Name of the network interface the routes go through
+	Name() string
+	// Read fails with a timeout error past t
+	SetReadDeadline(t time.Time) error
+}
+
+// UserspaceDevice is a Device the host doesn't know about. Nothing is configured on the host for it: no routes,
+// addresses, MTU or DNS. All the traffic it carries goes into the tunnel
+type UserspaceDevice interface {
+	Device
+	// SetAddress replaces the tunnel address (CIDR) of the device
+	SetAddress(cidr string) error
+	SetMTU(mtu int) error
+	// SetDNS makes the device resolve names with servers, nil uses the resolver of the host
+	SetDNS(servers []string)
+}
+
+type tun_device struct {
+	*water.Interface
+	file *os.File
+}
+
+func (v tun_device) SetReadDeadline(t time.Time) error {
+	return v.file.SetReadDeadline(t)
+}
+
+// NewTunDevice wraps a TUN device, which must have a file descriptor supporting deadlines
+func NewTunDevice(iface *water.Interface) (Device, error) {
+	file, ok := iface.ReadWriteCloser.(*os.File)
+	if !ok {
+		return nil, fmt.Errorf("water.Interface %v is does not have a valid file descriptor", iface)
+	}
+	return tun_device{Interface: iface, file: file}, nil
+}
+
+// userspace returns the device when it is a UserspaceDevice
+func (v *Pipe) userspace() (UserspaceDevice, bool) {
+	device, ok := v.Iface.(UserspaceDevice)
+	return device, ok
+}
@@ -0,0 +1,397 @@
+package piper
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/packet"
+)
+
+// Direction of a packet relative to the local host
+type DIRECTION int
+
+// Packet read from the TUN device, going to the peer
+const OUT DIRECTION = 1
+
+// Packet received from the peer, going to the TUN device
+const IN DIRECTION = 2
+
+const ANY_DIRECTION DIRECTION = OUT | IN
+
+// Rule set used for peers without a rule set of their own
+const DEFAULT_PEER = "*"
+
+const ANY = -1
+
+// How long an idle flow allowed by a keep-state rule is remembered
+const TCP_FLOW_TIMEOUT = 10 * time.Minute
+const FLOW_TIMEOUT = 1 * time.Minute
+
+type port_range struct {
+	from int
+	to   int
+}
+
+func (v port_range) match(port uint16) bool {
+	return v.from == ANY || (int(port) >= v.from && int(port) <= v.to)
+}
+
+type Rule struct {
+	// Identifies the rule in the stats, `<peer>:<line> <rule text>`
+	Name      string
+	Allow     bool
+	Direction DIRECTION
+	Protocol  int
+	From      netip.Prefix
+	To        netip.Prefix
+	SrcPorts  port_range
+	DstPorts  port_range
+	ICMPType  int
+	// Remember the flow so the reply direction is allowed too
+	KeepState bool
+}
+
+func (v *Rule) match(h packet.Header, direction DIRECTION) bool {
+	if v.Direction&direction == 0 {
+		return false
+	}
+	if v.Protocol != ANY && int(h.Protocol) != v.Protocol {
+		return false
+	}
+	if v.From.IsValid() && !v.From.Contains(h.Src) {
+		return false
+	}
+	if v.To.IsValid() && !v.To.Contains(h.Dst) {
+		return false
+	}
+	switch h.Protocol {
+	case packet.PROTO_TCP, packet.PROTO_UDP:
+		// non first fragments have no ports, they never match a port rule
+		if h.Fragment && (v.SrcPorts.from != ANY || v.DstPorts.from != ANY) {
+			return false
+		}
+		if !v.SrcPorts.match(h.SrcPort) || !v.DstPorts.match(h.DstPort) {
+			return false
+		}
+	case packet.PROTO_ICMP, packet.PROTO_ICMPV6:
+		if v.ICMPType != ANY && (h.Fragment || int(h.SrcPort) != v.ICMPType) {
+			return false
+		}
+	}
+	return true
+}
+
+type RuleSet struct {
+	Peer    string
+	Rules   []*Rule
+	Default bool
+}
+
+// Filter holds the rule sets of all peers, loaded from a rules file
+type Filter struct {
+	Sets map[string]*RuleSet
+}
+
+// ForPeer returns the rule set of the peer, or the default one
+func (v *Filter) ForPeer(peer string) *RuleSet {
+	if result, ok := v.Sets[peer]; ok {
+		return result
+	}
+	return v.Sets[DEFAULT_PEER]
+}
+
+// LoadFilter reads a rules file. Each line is one of
+//
+//	peer <common name>|*
+//	default allow|deny
+//	allow|deny [in|out] [proto tcp|udp|icmp|icmpv6|<number>] [from <prefix>] [to <prefix>]
+//	           [sport <port>[-<port>]] [dport <port>[-<port>]] [type <icmp type>] [keep-state]
+//
+// Rules before any peer line belong to `*`, used for peers without a rule set of their own.
+// Rules are evaluated in order, the first match wins. Without a match the default (allow) applies
+func LoadFilter(path string) (*Filter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	result := &Filter{
+		Sets: make(map[string]*RuleSet),
+	}
+	current := &RuleSet{Peer: DEFAULT_PEER, Default: true}
+	result.Sets[DEFAULT_PEER] = current
+	scanner := bufio.NewScanner(file)
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		line := scanner.Text()
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) == 0 {
+			continue
+		}
+		switch tokens[0] {
+		case "peer":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("%s:%d: peer requires a name", path, line_number)
+			}
+			existing, ok := result.Sets[tokens[1]]
+			if !ok {
+				existing = &RuleSet{Peer: tokens[1], Default: true}
+				result.Sets[tokens[1]] = existing
+			}
+			current = existing
+		case "default":
+			if len(tokens) != 2 || (tokens[1] != "allow" && tokens[1] != "deny") {
+				return nil, fmt.Errorf("%s:%d: default requires allow or deny", path, line_number)
+			}
+			current.Default = tokens[1] == "allow"
+		case "allow", "deny":
+			rule, err := parse_rule(tokens)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, line_number, err)
+			}
+			rule.Name = fmt.Sprintf("%s:%d %s", current.Peer, line_number, strings.Join(tokens, " "))
+			current.Rules = append(current.Rules, rule)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown keyword %s", path, line_number, tokens[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func parse_rule(tokens []string) (*Rule, error) {
+	result := &Rule{
+		Allow:     tokens[0] == "allow",
+		Direction: ANY_DIRECTION,
+		Protocol:  ANY,
+		SrcPorts:  port_range{ANY, ANY},
+		DstPorts:  port_range{ANY, ANY},
+		ICMPType:  ANY,
+	}
+	var err error
+	for i := 1; i < len(tokens); i++ {
+		keyword := tokens[i]
+		switch keyword {
+		case "in":
+			result.Direction = IN
+			continue
+		case "out":
+			result.Direction = OUT
+			continue
+		case "keep-state":
+			result.KeepState = true
+			continue
+		}
+		if i+1 >= len(tokens) {
+			return nil, fmt.Errorf("%s requires a value", keyword)
+		}
+		i++
+		value := tokens[i]
+		switch keyword {
+		case "proto":
+			result.Protocol, err = parse_protocol(value)
+		case "from":
+			result.From, err = parse_prefix(value)
+		case "to":
+			result.To, err = parse_prefix(value)
+		case "sport":
+			result.SrcPorts, err = parse_port_range(value)
+		case "dport":
+			result.DstPorts, err = parse_port_range(value)
+		case "type":
+			result.ICMPType, err = strconv.Atoi(value)
+			if err == nil && (result.ICMPType < 0 || result.ICMPType > 255) {
+				err = fmt.Errorf("invalid icmp type %s", value)
+			}
+		default:
+			err = fmt.Errorf("unknown keyword %s", keyword)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func parse_protocol(value string) (int, error) {
+	switch value {
+	case "any":
+		return ANY, nil
+	case "tcp":
+		return int(packet.PROTO_TCP), nil
+	case "udp":
+		return int(packet.PROTO_UDP), nil
+	case "icmp":
+		return int(packet.PROTO_ICMP), nil
+	case "icmpv6":
+		return int(packet.PROTO_ICMPV6), nil
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 0 || result > 255 {
+		return 0, fmt.Errorf("invalid protocol %s", value)
+	}
+	return result, nil
+}
+
+// parse_prefix accepts a CIDR or a single address
+func parse_prefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		result, err := netip.ParsePrefix(value)
+		return result.Masked(), err
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parse_port_range(value string) (port_range, error) {
+	from_s, to_s, found := strings.Cut(value, "-")
+	if !found {
+		to_s = from_s
+	}
+	from, err1 := strconv.Atoi(from_s)
+	to, err2 := strconv.Atoi(to_s)
+	if err1 != nil || err2 != nil || from < 0 || to > 0xffff || from > to {
+		return port_range{}, fmt.Errorf("invalid port range %s", value)
+	}
+	return port_range{from, to}, nil
+}
+
+type flow_key struct {
+	protocol byte
+	src      netip.Addr
+	dst      netip.Addr
+	sport    uint16
+	dport    uint16
+}
+
+func new_flow_key(h packet.Header) flow_key {
+	result := flow_key{
+		protocol: h.Protocol,
+		src:      h.Src,
+		dst:      h.Dst,
+	}
+	// ICMP request and reply have different types, only track the addresses
+	if h.Protocol == packet.PROTO_TCP || h.Protocol == packet.PROTO_UDP {
+		result.sport = h.SrcPort
+		result.dport = h.DstPort
+	}
+	return result
+}
+
+func (v flow_key) reverse() flow_key {
+	return flow_key{
+		protocol: v.protocol,
+		src:      v.dst,
+		dst:      v.src,
+		sport:    v.dport,
+		dport:    v.sport,
+	}
+}
+
+// flow_table remembers the flows allowed by keep-state rules of one session
+type flow_table struct {
+	mutex  sync.Mutex
+	flows  map[flow_key]time.Time
+	purged time.Time
+}
+
+func new_flow_table() *flow_table {
+	return &flow_table{
+		flows:  make(map[flow_key]time.Time),
+		purged: time.Now(),
+	}
+}
+
+func flow_timeout(protocol byte) time.Duration {
+	if protocol == packet.PROTO_TCP {
+		return TCP_FLOW_TIMEOUT
+	}
+	return FLOW_TIMEOUT
+}
+
+// lookup is true when the packet belongs to a remembered flow, in either direction
+func (v *flow_table) lookup(key flow_key) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	now := time.Now()
+	for _, next := range []flow_key{key, key.reverse()} {
+		expiry, ok := v.flows[next]
+		if ok && now.Before(expiry) {
+			v.flows[next] = now.Add(flow_timeout(key.protocol))
+			return true
+		}
+	}
+	return false
+}
+
+func (v *flow_table) add(key flow_key) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	now := time.Now()
+	v.flows[key] = now.Add(flow_timeout(key.protocol))
+	if now.Sub(v.purged) > FLOW_TIMEOUT {
+		for next, expiry := range v.flows {
+			if now.After(expiry) {
+				delete(v.flows, next)
+			}
+		}
+		v.purged = now
+	}
+}
+
+// permit applies the peer's rule set to a packet and counts the matching rule
+func (v *Pipe) permit(data []byte, direction DIRECTION) bool {
+	rules := v.rules.Load()
+	if rules == nil {
+		return true
+	}
+	header, err := packet.Parse(data)
+	if err != nil {
+		return rules.Default
+	}
+	key := new_flow_key(header)
+	if v.flows.lookup(key) {
+		return true
+	}
+	for _, rule := range rules.Rules {
+		if !rule.match(header, direction) {
+			continue
+		}
+		v.Stats.IncreaseRuleHit(rule.Name)
+		if rule.Allow && rule.KeepState {
+			v.flows.add(key)
+		}
+		return rule.Allow
+	}
+	v.Stats.IncreaseRuleHit(rules.Peer + ":default")
+	return rules.Default
+}
+
+// SetFilter replaces the filter of a running pipe, e.g. after the rules file is reloaded.
+// Remembered flows are kept
+func (v *Pipe) SetFilter(filter *Filter) {
+	v.Filter = filter
+	if filter == nil {
+		v.rules.Store(nil)
+		return
+	}
+	rules := filter.ForPeer(v.Transport.PeerName())
+	v.logger(logging.PIPER).Info("Filtering", "rule_set", rules.Peer, "rules", len(rules.Rules), "peer", v.Transport.PeerName())
+	v.rules.Store(rules)
+}
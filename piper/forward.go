@@ -0,0 +1,470 @@
+package piper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wushilin/go-vpn/common"
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/message"
+	"github.com/wushilin/go-vpn/transport"
+)
+
+const FORWARD_TCP = "tcp"
+const FORWARD_UDP = "udp"
+
+// Time to connect to the target of a forwarded connection
+const FORWARD_DIAL_TIMEOUT = 10 * time.Second
+
+// A forwarded UDP flow without datagrams for this long is closed
+const UDP_FORWARD_TIMEOUT = time.Minute
+
+// Largest datagram of a forwarded UDP flow
+const MAX_DATAGRAM = 65535
+
+// Forward is a port forwarded through the tunnel: connections to Listen on one side reach Target from the other side
+type Forward struct {
+	Protocol string
+	Listen   string
+	Target   string
+}
+
+// String is the form ParseForward reads, [tcp/|udp/]listen=target
+func (v Forward) String() string {
+	return fmt.Sprintf("%s/%s=%s", v.Protocol, v.Listen, v.Target)
+}
+
+// ParseForward reads [tcp/|udp/][host]:port=host:port, tcp by default
+func ParseForward(value string) (Forward, error) {
+	result := Forward{Protocol: FORWARD_TCP}
+	if protocol, rest, ok := strings.Cut(value, "/"); ok && (protocol == FORWARD_TCP || protocol == FORWARD_UDP) {
+		result.Protocol = protocol
+		value = rest
+	}
+	listen, target, ok := strings.Cut(value, "=")
+	if !ok {
+		return result, fmt.Errorf("invalid forward %s, expect [tcp/|udp/][host]:port=host:port", value)
+	}
+	if _, _, err := net.SplitHostPort(listen); err != nil {
+		return result, fmt.Errorf("invalid listen address %s: %w", listen, err)
+	}
+	if host, _, err := net.SplitHostPort(target); err != nil || host == "" {
+		return result, fmt.Errorf("invalid target %s, expect host:port", target)
+	}
+	result.Listen = listen
+	result.Target = target
+	return result, nil
+}
+
+// ParseForwards reads a comma separated list of forwards
+func ParseForwards(value string) ([]Forward, error) {
+	var result []Forward
+	for _, next := range common.ToList(value) {
+		forward, err := ParseForward(next)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, forward)
+	}
+	return result, nil
+}
+
+// opener opens the stream of a forwarded connection to the peer, which connects to the target
+type opener func(ctx context.Context, forward Forward) (transport.Stream, error)
+
+// start_forwards listens for LocalForwards, asks the peer to listen for RemoteForwards and serves the
+// forwarded connections the peer opens, until ctx is done. On a hub the server listens for LocalForwards
+// once for all sessions, see Hub.ListenForwards
+func (v *Pipe) start_forwards(ctx context.Context) {
+	logger := v.logger(logging.PIPER)
+	if v.Hub == nil {
+		for _, forward := range v.LocalForwards {
+			if err := v.listen_forward(ctx, forward); err != nil {
+				logger.Error("Unable to forward port", "forward", forward, "error", err)
+			}
+		}
+	}
+	for _, forward := range v.RemoteForwards {
+		logger.Info("Asking peer to forward port", "forward", forward)
+		if err := v.SendControlCommand(message.Forward(forward.String())); err != nil {
+			logger.Error("Unable to ask peer to forward port", "forward", forward, "error", err)
+		}
+	}
+	go func() {
+		for {
+			stream, err := v.Transport.AcceptForward(ctx)
+			if err != nil {
+				return
+			}
+			go v.serve_forward(stream)
+		}
+	}()
+}
+
+// close_forwards stops listening, the forwarded connections end with the transport
+func (v *Pipe) close_forwards() {
+	v.forward_mutex.Lock()
+	defer v.forward_mutex.Unlock()
+	for _, listener := range v.forward_listeners {
+		listener.Close()
+	}
+	v.forward_listeners = nil
+}
+
+// handle_forward listens on this side for a forward the peer asks for, when AcceptForwards allows it
+func (v *Pipe) handle_forward(ctx context.Context, cmd message.Command) error {
+	logger := v.logger(logging.PIPER)
+	forward, err := ParseForward(string(cmd.Data))
+	if err != nil {
+		logger.Error("Invalid forward asked by the peer", "error", err)
+		return v.SendControlCommand(message.FAIL())
+	}
+	if !v.AcceptForwards {
+		logger.Warn("Peer asked to forward a port, not accepted", "forward", forward)
+		return v.SendControlCommand(message.FAIL())
+	}
+	if err := v.listen_forward(ctx, forward); err != nil {
+		logger.Error("Unable to forward port for the peer", "forward", forward, "error", err)
+		return v.SendControlCommand(message.FAIL())
+	}
+	return v.SendControlCommand(message.OK())
+}
+
+// listen_forward accepts the connections to forward.Listen for the session, closed with it
+func (v *Pipe) listen_forward(ctx context.Context, forward Forward) error {
+	listener, err := listen_forward(ctx, forward, v.open_forward, v.logger(logging.PIPER))
+	if err != nil {
+		return err
+	}
+	v.forward_mutex.Lock()
+	v.forward_listeners = append(v.forward_listeners, listener)
+	v.forward_mutex.Unlock()
+	return nil
+}
+
+// listen_forward accepts the connections to forward.Listen and forwards each over its own stream, opened with open
+func listen_forward(ctx context.Context, forward Forward, open opener, logger *slog.Logger) (io.Closer, error) {
+	var listener io.Closer
+	if forward.Protocol == FORWARD_UDP {
+		socket, err := net.ListenPacket("udp", forward.Listen)
+		if err != nil {
+			return nil, err
+		}
+		listener = socket
+		go forward_udp(ctx, socket, forward, open, logger)
+	} else {
+		socket, err := net.Listen("tcp", forward.Listen)
+		if err != nil {
+			return nil, err
+		}
+		listener = socket
+		go forward_tcp(ctx, socket, forward, open, logger)
+	}
+	logger.Info("Forwarding port", "forward", forward)
+	return listener, nil
+}
+
+func forward_tcp(ctx context.Context, listener net.Listener, forward Forward, open opener, logger *slog.Logger) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			stream, err := open(ctx, forward)
+			if err != nil {
+				logger.Warn("Unable to forward connection", "forward", forward, "error", err)
+				conn.Close()
+				return
+			}
+			splice(conn, stream)
+		}()
+	}
+}
+
+// ListenForwards listens for the forwards once for all the sessions of the hub, until ctx is done. Each connection
+// goes to the session owning the target address, or to the only session
+func (v *Hub) ListenForwards(ctx context.Context, forwards []Forward) {
+	logger := logging.For(logging.PIPER)
+	var listeners []io.Closer
+	for _, forward := range forwards {
+		listener, err := listen_forward(ctx, forward, v.open_forward, logger)
+		if err != nil {
+			logger.Error("Unable to forward port", "forward", forward, "error", err)
+			continue
+		}
+		listeners = append(listeners, listener)
+	}
+	go func() {
+		<-ctx.Done()
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+}
+
+// open_forward opens the stream of a forwarded connection to the client that reaches the target
+func (v *Hub) open_forward(ctx context.Context, forward Forward) (transport.Stream, error) {
+	host, _, _ := net.SplitHostPort(forward.Target)
+	var to *Pipe
+	if address, err := netip.ParseAddr(host); err == nil {
+		to = v.lookup_address(address.Unmap())
+	}
+	if pipes := v.Pipes(); to == nil && len(pipes) == 1 {
+		to = pipes[0]
+	}
+	if to == nil {
+		return nil, fmt.Errorf("no session reaches %s", forward.Target)
+	}
+	return to.open_forward(ctx, forward)
+}
+
+// open_forward opens the stream of a forwarded connection, the peer connects to the target
+func (v *Pipe) open_forward(ctx context.Context, forward Forward) (transport.Stream, error) {
+	stream, err := v.Transport.OpenForward(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := write_frame(stream, []byte(forward.Protocol+"/"+forward.Target)); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// permits_forward tells whether this side connects to target for the peer: any target with AcceptForwards,
+// the targets of RemoteForwards otherwise
+func (v *Pipe) permits_forward(protocol string, target string) bool {
+	if v.AcceptForwards {
+		return true
+	}
+	return slices.ContainsFunc(v.RemoteForwards, func(forward Forward) bool {
+		return forward.Protocol == protocol && forward.Target == target
+	})
+}
+
+// serve_forward connects a stream opened by the peer to its target
+func (v *Pipe) serve_forward(stream transport.Stream) {
+	logger := v.logger(logging.PIPER)
+	header, err := read_frame(stream, make([]byte, 512))
+	if err != nil {
+		logger.Warn("Invalid forwarded connection", "error", err)
+		stream.Close()
+		return
+	}
+	protocol, target, _ := strings.Cut(string(header), "/")
+	if !v.permits_forward(protocol, target) {
+		logger.Warn("Forwarded connection not accepted", "protocol", protocol, "target", target)
+		stream.Close()
+		return
+	}
+	conn, err := net.DialTimeout(protocol, target, FORWARD_DIAL_TIMEOUT)
+	if err != nil {
+		logger.Warn("Unable to connect forwarded connection", "protocol", protocol, "target", target, "error", err)
+		stream.Close()
+		return
+	}
+	logger.Debug("Forwarded connection", "protocol", protocol, "target", target)
+	if protocol == FORWARD_UDP {
+		serve_udp(conn, stream)
+		return
+	}
+	splice(conn, stream)
+}
+
+// splice copies both ways until both sides are done, each end of file is passed on
+func splice(conn net.Conn, stream transport.Stream) {
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(stream, conn)
+		stream.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, stream)
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	}()
+	wg.Wait()
+	conn.Close()
+	stream.Close()
+}
+
+// udp_flow is the stream of one UDP source of a forwarded port
+type udp_flow struct {
+	stream transport.Stream
+	last   time.Time
+}
+
+// forward_udp opens a stream per source address, datagrams go over it as frames
+func forward_udp(ctx context.Context, socket net.PacketConn, forward Forward, open opener, logger *slog.Logger) {
+	var mutex sync.Mutex
+	flows := make(map[string]*udp_flow)
+	go func() {
+		ticker := time.NewTicker(UDP_FORWARD_TIMEOUT / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			mutex.Lock()
+			for source, flow := range flows {
+				if time.Since(flow.last) > UDP_FORWARD_TIMEOUT {
+					flow.stream.Close()
+					delete(flows, source)
+				}
+			}
+			mutex.Unlock()
+		}
+	}()
+	buffer := make([]byte, MAX_DATAGRAM)
+	for {
+		size, source, err := socket.ReadFrom(buffer)
+		if err != nil {
+			mutex.Lock()
+			for _, flow := range flows {
+				flow.stream.Close()
+			}
+			mutex.Unlock()
+			return
+		}
+		mutex.Lock()
+		flow, ok := flows[source.String()]
+		mutex.Unlock()
+		if !ok {
+			stream, err := open(ctx, forward)
+			if err != nil {
+				logger.Warn("Unable to forward datagrams", "forward", forward, "error", err)
+				continue
+			}
+			flow = &udp_flow{stream: stream}
+			mutex.Lock()
+			flows[source.String()] = flow
+			mutex.Unlock()
+			go func() {
+				// later datagrams of the source open a new stream
+				defer func() {
+					mutex.Lock()
+					if flows[source.String()] == flow {
+						delete(flows, source.String())
+					}
+					mutex.Unlock()
+					stream.Close()
+				}()
+				reply := make([]byte, MAX_DATAGRAM)
+				for {
+					datagram, err := read_frame(stream, reply)
+					if err != nil {
+						return
+					}
+					mutex.Lock()
+					flow.last = time.Now()
+					mutex.Unlock()
+					socket.WriteTo(datagram, source)
+				}
+			}()
+		}
+		mutex.Lock()
+		flow.last = time.Now()
+		mutex.Unlock()
+		if err := write_frame(flow.stream, buffer[:size]); err != nil {
+			mutex.Lock()
+			if flows[source.String()] == flow {
+				delete(flows, source.String())
+			}
+			mutex.Unlock()
+			flow.stream.Close()
+		}
+	}
+}
+
+// serve_udp relays the frames of stream to the connected UDP socket and back, until no datagram went either way
+// for UDP_FORWARD_TIMEOUT or either side is closed
+func serve_udp(conn net.Conn, stream transport.Stream) {
+	defer conn.Close()
+	defer stream.Close()
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	go func() {
+		buffer := make([]byte, MAX_DATAGRAM)
+		for {
+			datagram, err := read_frame(stream, buffer)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			last.Store(time.Now().UnixNano())
+			conn.Write(datagram)
+		}
+	}()
+	buffer := make([]byte, MAX_DATAGRAM)
+	for {
+		idle := time.Since(time.Unix(0, last.Load()))
+		if idle >= UDP_FORWARD_TIMEOUT {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(UDP_FORWARD_TIMEOUT - idle))
+		size, err := conn.Read(buffer)
+		if err != nil {
+			var timeout net.Error
+			if errors.As(err, &timeout) && timeout.Timeout() {
+				// datagrams toward the target may have kept the flow alive
+				continue
+			}
+			// ICMP unreachable, the target may come up later
+			if !errors.Is(err, net.ErrClosed) {
+				continue
+			}
+			return
+		}
+		last.Store(time.Now().UnixNano())
+		if err := write_frame(stream, buffer[:size]); err != nil {
+			return
+		}
+	}
+}
+
+// write_frame writes data with a 2 bytes length, in one Write
+func write_frame(writer io.Writer, data []byte) error {
+	if len(data) > MAX_DATAGRAM {
+		return fmt.Errorf("frame of %d bytes too large", len(data))
+	}
+	frame := make([]byte, 2+len(data))
+	frame[0] = byte(len(data) / 256)
+	frame[1] = byte(len(data) % 256)
+	copy(frame[2:], data)
+	_, err := writer.Write(frame)
+	return err
+}
+
+// read_frame reads a frame of write_frame into buffer
+func read_frame(reader io.Reader, buffer []byte) ([]byte, error) {
+	if _, err := io.ReadFull(reader, buffer[:2]); err != nil {
+		return nil, err
+	}
+	size := int(buffer[0])*256 + int(buffer[1])
+	if size > len(buffer) {
+		return nil, fmt.Errorf("frame of %d bytes exceeds buffer of %d bytes", size, len(buffer))
+	}
+	if _, err := io.ReadFull(reader, buffer[:size]); err != nil {
+		return nil, err
+	}
+	return buffer[:size], nil
+}
@@ -0,0 +1,260 @@
+package piper
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/songgao/water"
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/packet"
+	"github.com/wushilin/go-vpn/stats"
+	"github.com/wushilin/go-vpn/transport"
+)
+
+// Packets waiting for a session of the hub, more are dropped
+const HUB_QUEUE = 1024
+
+// Client-to-client policies of the hub
+const CLIENT_TO_CLIENT_ALLOW = "allow"
+const CLIENT_TO_CLIENT_DENY = "deny"
+
+// Hub shares the TUN device of the server between the sessions of several clients. Every session
+// announces its networks with CMD_SUBNET_UPDATE, the hub keeps them in an in-process routing table,
+// sends the packets read from the TUN device to the session owning the destination and forwards packets
+// between clients directly, without a round trip through the kernel. Each session has its own queue of
+// HUB_QUEUE packets, a stalled client only loses its own packets
+type Hub struct {
+	Iface *water.Interface
+	File  *os.File
+	Stats *stats.GlobalStats
+	// Lets a client reach the networks announced by another client. Otherwise these packets are dropped
+	ClientToClient bool
+
+	mutex sync.RWMutex
+	// longest prefix first
+	table []hub_route
+	pipes []*Pipe
+	// session announcing each network, also while it is set up
+	owners map[netip.Prefix]*Pipe
+}
+
+type hub_route struct {
+	prefix netip.Prefix
+	pipe   *Pipe
+}
+
+func NewHub(iface *water.Interface, stats *stats.GlobalStats) (*Hub, error) {
+	file, ok := iface.ReadWriteCloser.(*os.File)
+	if !ok {
+		return nil, fmt.Errorf("water.Interface %v is does not have a valid file descriptor", iface)
+	}
+	return &Hub{
+		Iface:  iface,
+		File:   file,
+		Stats:  stats,
+		owners: make(map[netip.Prefix]*Pipe),
+	}, nil
+}
+
+// parse_route reads a route as announced, a network or a single address
+func parse_route(cidr string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(cidr); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid route %s", cidr)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// claim reserves the network for the session before its route is installed, fails when another
+// session announced it. The claim ends with remove, release or detach
+func (v *Hub) claim(pipe *Pipe, cidr string) error {
+	prefix, err := parse_route(cidr)
+	if err != nil {
+		return err
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if owner, ok := v.owners[prefix]; ok && owner != pipe {
+		return fmt.Errorf("route %s is announced by session %s (%s)", cidr, owner.Session, owner.peer_name)
+	}
+	v.owners[prefix] = pipe
+	return nil
+}
+
+// release ends the claim of the session on the network, its route couldn't be installed
+func (v *Hub) release(pipe *Pipe, cidr string) {
+	prefix, err := parse_route(cidr)
+	if err != nil {
+		return
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.owners[prefix] == pipe {
+		delete(v.owners, prefix)
+	}
+}
+
+// attach starts routing to an established session, with the routes it installed during the setup
+func (v *Hub) attach(pipe *Pipe) {
+	v.mutex.Lock()
+	v.pipes = append(v.pipes, pipe)
+	v.mutex.Unlock()
+	for _, cidr := range pipe.InstalledRoutes() {
+		v.add(pipe, cidr)
+	}
+	v.count_routes()
+}
+
+// detach stops routing to the session
+func (v *Hub) detach(pipe *Pipe) {
+	v.mutex.Lock()
+	v.pipes = slices.DeleteFunc(v.pipes, func(next *Pipe) bool {
+		return next == pipe
+	})
+	v.table = slices.DeleteFunc(v.table, func(next hub_route) bool {
+		return next.pipe == pipe
+	})
+	maps.DeleteFunc(v.owners, func(_ netip.Prefix, owner *Pipe) bool {
+		return owner == pipe
+	})
+	v.mutex.Unlock()
+	v.count_routes()
+}
+
+// add routes cidr to the session. Ignored until the session is attached
+func (v *Hub) add(pipe *Pipe, cidr string) {
+	prefix, err := parse_route(cidr)
+	if err != nil {
+		return
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if !slices.Contains(v.pipes, pipe) {
+		return
+	}
+	v.table = append(v.table, hub_route{prefix: prefix, pipe: pipe})
+	slices.SortStableFunc(v.table, func(a, b hub_route) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+}
+
+func (v *Hub) remove(pipe *Pipe, cidr string) {
+	prefix, err := parse_route(cidr)
+	if err != nil {
+		return
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.table = slices.DeleteFunc(v.table, func(next hub_route) bool {
+		return next.pipe == pipe && next.prefix == prefix
+	})
+	if v.owners[prefix] == pipe {
+		delete(v.owners, prefix)
+	}
+}
+
+// count_routes records the routes of all sessions
+func (v *Hub) count_routes() {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	v.Stats.SetRoutes(len(v.table))
+}
+
+// lookup returns the session owning the destination of the packet, nil when there is none
+func (v *Hub) lookup(data []byte) *Pipe {
+	header, err := packet.Parse(data)
+	if err != nil {
+		return nil
+	}
+	return v.lookup_address(header.Dst)
+}
+
+// lookup_address returns the session owning the address, nil when there is none
+func (v *Hub) lookup_address(address netip.Addr) *Pipe {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	for _, next := range v.table {
+		if next.prefix.Contains(address) {
+			return next.pipe
+		}
+	}
+	return nil
+}
+
+// destination returns the session a packet read from the TUN device goes to: the owner of its destination or,
+// when no session announced it, the only session. Like a point to point server, the kernel routes decide then
+func (v *Hub) destination(data []byte) *Pipe {
+	if to := v.lookup(data); to != nil {
+		return to
+	}
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	if len(v.pipes) == 1 {
+		return v.pipes[0]
+	}
+	return nil
+}
+
+// Pipes lists the established sessions
+func (v *Hub) Pipes() []*Pipe {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	return slices.Clone(v.pipes)
+}
+
+// forward sends a packet received from a client to the client owning its destination.
+// False when the destination is not another client, the packet goes to the TUN device then
+func (v *Hub) forward(from *Pipe, data []byte) bool {
+	to := v.lookup(data)
+	if to == nil || to == from {
+		return false
+	}
+	if !v.ClientToClient {
+		v.Stats.IncreaseDropped(stats.DROP_CLIENT_TO_CLIENT)
+		return true
+	}
+	to.enqueue(data)
+	return true
+}
+
+// Run reads the TUN device and sends every packet to the session owning its destination, until ctx is done.
+// Fails when the device can't be read anymore
+func (v *Hub) Run(ctx context.Context) error {
+	logger := logging.For(logging.PIPER).With("loop", "tun dev -> hub")
+	logger.Debug("Loop started")
+	defer func() {
+		logger.Debug("Loop ended")
+	}()
+	buffer := make([]byte, transport.BUFFER_SIZE)
+	for ctx.Err() == nil {
+		v.File.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		nread, err := v.File.Read(buffer)
+		if err != nil {
+			if os.IsTimeout(err) {
+				continue
+			}
+			logger.Error("Read failed", "error", err)
+			v.Stats.IncreaseError(stats.ERROR_TUN_READ)
+			return fmt.Errorf("unable to read %s: %w", v.Iface.Name(), err)
+		}
+		to := v.destination(buffer[:nread])
+		if to == nil {
+			v.Stats.IncreaseDropped(stats.DROP_NO_ROUTE)
+			continue
+		}
+		if to.stopping.Load() {
+			continue
+		}
+		to.enqueue(buffer[:nread])
+	}
+	return nil
+}
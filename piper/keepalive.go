@@ -0,0 +1,105 @@
+package piper
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/message"
+)
+
+// echo_state tracks the ECHO probes that are still waiting for a reply
+type echo_state struct {
+	mutex       sync.Mutex
+	seq         uint64
+	pending     map[uint64]time.Time
+	consecutive int
+}
+
+func new_echo_state() *echo_state {
+	return &echo_state{
+		pending: make(map[uint64]time.Time),
+	}
+}
+
+// keepalive sends an ECHO every EchoInterval. A probe not answered within the interval is lost.
+// When EchoFailLimit probes in a row are lost the link is failed, even if QUIC still thinks
+// the connection is alive (e.g. the route to the server goes through the tunnel itself)
+func (v *Pipe) keepalive(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if v.EchoInterval <= 0 {
+		return
+	}
+	logger := v.logger(logging.CONTROL)
+	logger.Debug("Keepalive started", "interval", v.EchoInterval, "fail_limit", v.EchoFailLimit)
+	defer func() {
+		logger.Debug("Keepalive ended")
+	}()
+	ticker := time.NewTicker(v.EchoInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-v.done:
+			return
+		case <-ticker.C:
+		}
+		lost := v.expire_echoes(time.Now().Add(-v.EchoInterval))
+		if v.EchoFailLimit > 0 && lost >= v.EchoFailLimit {
+			logger.Warn("Probes lost in a row. Failing the link", "lost", lost)
+			v.Fail()
+			v.Transport.Close()
+			return
+		}
+		seq := v.next_echo()
+		if err := v.SendControlCommand(message.Echo(seq)); err != nil {
+			logger.Warn("Send echo failed", "error", err)
+			v.Fail()
+			return
+		}
+		v.Stats.IncreaseEchoSent()
+	}
+}
+
+func (v *Pipe) next_echo() uint64 {
+	v.echo.mutex.Lock()
+	defer v.echo.mutex.Unlock()
+	v.echo.seq++
+	v.echo.pending[v.echo.seq] = time.Now()
+	return v.echo.seq
+}
+
+// expire_echoes counts the probes sent before deadline as lost and
+// returns the number of consecutive losses so far
+func (v *Pipe) expire_echoes(deadline time.Time) int {
+	v.echo.mutex.Lock()
+	defer v.echo.mutex.Unlock()
+	for seq, sent := range v.echo.pending {
+		if sent.Before(deadline) {
+			delete(v.echo.pending, seq)
+			v.echo.consecutive++
+			v.Stats.IncreaseEchoLost()
+		}
+	}
+	return v.echo.consecutive
+}
+
+func (v *Pipe) handle_echo_reply(cmd message.Command) {
+	seq, err := cmd.Sequence()
+	if err != nil {
+		v.logger(logging.CONTROL).Warn("Ignoring echo reply", "error", err)
+		return
+	}
+	v.echo.mutex.Lock()
+	defer v.echo.mutex.Unlock()
+	sent, ok := v.echo.pending[seq]
+	if !ok {
+		// too late, already counted as lost
+		return
+	}
+	delete(v.echo.pending, seq)
+	v.echo.consecutive = 0
+	v.Stats.RecordRTT(time.Since(sent))
+}
@@ -0,0 +1,58 @@
+package piper
+
+import (
+	"sync"
+	"time"
+)
+
+// Smallest burst of a limiter, a few full sized packets
+const MIN_BURST = 16 * 1024
+
+// limiter polices the bytes per second of one direction with a token bucket.
+// Packets over the rate are dropped, TCP slows down on its own
+type limiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// new_limiter allows rate bytes per second with bursts of a quarter second. nil when rate is 0 (unlimited)
+func new_limiter(rate uint64) *limiter {
+	if rate == 0 {
+		return nil
+	}
+	burst := max(float64(rate)/4, MIN_BURST)
+	return &limiter{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// bandwidth is the rate the limiter was created with, 0 for nil
+func (v *limiter) bandwidth() uint64 {
+	if v == nil {
+		return 0
+	}
+	return uint64(v.rate)
+}
+
+// allow takes size bytes from the bucket, false when they are not there
+func (v *limiter) allow(size int) bool {
+	if v == nil {
+		return true
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	now := time.Now()
+	v.tokens = min(v.burst, v.tokens+now.Sub(v.last).Seconds()*v.rate)
+	v.last = now
+	if v.tokens < float64(size) {
+		return false
+	}
+	v.tokens -= float64(size)
+	return true
+}
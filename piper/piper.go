@@ -4,27 +4,122 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/songgao/water"
 	"github.com/wushilin/go-vpn/common"
+	"github.com/wushilin/go-vpn/hooks"
+	"github.com/wushilin/go-vpn/logging"
 	"github.com/wushilin/go-vpn/message"
+	"github.com/wushilin/go-vpn/packet"
 	"github.com/wushilin/go-vpn/stats"
 	"github.com/wushilin/go-vpn/transport"
 )
 
+// Default tunnel MTU. The packets travel in QUIC streams, which split them over as many QUIC packets as needed,
+// so the path doesn't limit it; 1400 keeps the packets the hosts send into the tunnel at a common size
+const DEFAULT_MTU = 1400
+
+// Smallest tunnel MTU, the IPv6 minimum link MTU (RFC 8200)
+const MIN_MTU = 1280
+
+// MSSClamp value that derives the MSS from the negotiated MTU
+const MSS_CLAMP_AUTO = -1
+
 type Pipe struct {
-	Iface     *water.Interface
-	File      *os.File
+	Iface     Device
 	Transport transport.Transport
 	FailFlag  bool
 	Mutex     *sync.Mutex
-	Routes    []string
-	Stats     *stats.GlobalStats
+	// Routes this side asks the peer to send into the tunnel, in addition to Address
+	Routes []string
+	Stats  *stats.GlobalStats
+	// Tunnel address (CIDR) of this side. A client takes the address the server assigns
+	Address string
+	// Client: how pushed DNS settings are applied, see common.SetDNS. Empty is common.DNS_OFF
+	DNSMode string
+	// What is done with requested routes conflicting with the routes of the host. nil is DEFAULT_CONFLICT_POLICY
+	Conflicts ConflictPolicy
+	// Ports this side listens on, forwarded to targets the peer connects to (like ssh -L)
+	LocalForwards []Forward
+	// Ports the peer is asked to listen on, forwarded to targets this side connects to (like ssh -R)
+	RemoteForwards []Forward
+	// Listen and connect for the forwards of the peer. The targets of RemoteForwards are always connected
+	AcceptForwards bool
+	// Client: send all traffic into the tunnel, whether the server pushes the default route or not
+	FullTunnel bool
+	// How often an ECHO probe is sent over the control stream. 0 disables probing
+	EchoInterval time.Duration
+	// Number of consecutive lost probes before the link is considered dead
+	EchoFailLimit int
+	// Tunnel MTU this side proposes. 0 means DEFAULT_MTU. Capped by the transport payload
+	LocalMTU int
+	// MSS clamping of TCP SYN packets crossing the tunnel. 0 disables, MSS_CLAMP_AUTO derives it from MTU
+	MSSClamp int
+	// Identifies the session in the logs
+	Session string
+	// Packet filter applied in both directions. nil allows everything
+	Filter *Filter
+	// Packet capture shared by the sessions. nil disables capturing
+	Capture *Capture
+	// How long a shutdown waits for the peer to answer GOODBYE. 0 means DRAIN_TIMEOUT
+	DrainTimeout time.Duration
+	// Notified when the session goes up or down and when routes change. nil disables
+	Hooks *hooks.Hooks
+	// Shares the TUN device with other sessions, reads it and routes to this session. nil when the pipe owns the device
+	Hub *Hub
+
+	done      chan struct{}
+	fail_once *sync.Once
+	// set when the session is being ended on purpose, by either side
+	stopping     atomic.Bool
+	goodbye      chan struct{}
+	goodbye_once sync.Once
+	echo         *echo_state
+	rules        atomic.Pointer[RuleSet]
+	flows        *flow_table
+	// tunnel MTU agreed with the peer, set on the TUN device
+	mtu atomic.Int32
+	// when the session was established, nil during setup
+	started   atomic.Pointer[time.Time]
+	peer      *stats.PeerStats
+	peer_name string
+	installed []string
+	// routes of the host the installed routes replaced, by installed route
+	replaced     map[string]common.KernelRoute
+	route_policy RoutePolicy
+	// guards installed, replaced and route_policy. Separate from Mutex, routes are added while a control command is processed
+	routes_mutex sync.Mutex
+	limit_in     atomic.Pointer[limiter]
+	limit_out    atomic.Pointer[limiter]
+	// Server: configuration pushed to the client. Client: configuration received. Guarded by push_mutex,
+	// the profiles are reloaded while the control loop runs
+	push PushConfig
+	// Server: tunnel address assigned to the client, empty lets the client keep its own. Guarded by push_mutex
+	peer_address string
+	// name of the profile applied to the session, guarded by push_mutex
+	profile    string
+	push_mutex sync.Mutex
+	// what apply_push changed, undone by revert_push
+	revert_dns     func()
+	default_routes []string
+	pinned         string
+	// packets the hub routed to the session, written to the transport by queue_to_transport
+	outbound chan []byte
+	// listeners of the forwarded ports, closed with the session
+	forward_listeners []io.Closer
+	forward_mutex     sync.Mutex
+}
+
+// logger of the subsystem, tagged with the session
+func (v *Pipe) logger(subsystem string) *slog.Logger {
+	return logging.For(subsystem).With("session", v.Session)
 }
 
 func (v *Pipe) AtomicExecute(target func()) {
@@ -37,25 +132,34 @@ func (v *Pipe) ExecuteControlCommand(cmd message.Command) (message.Command, erro
 	var result message.Command
 	var rerr error
 	v.AtomicExecute(func() {
-		log.Printf("Sending command")
+		v.logger(logging.CONTROL).Debug("Sending command", "type", cmd.Type)
 		_, err := v.Transport.WriteControlCommand(cmd)
 		if err != nil {
 			rerr = err
+		} else {
+			v.count_command(SENT, cmd.Type)
 		}
 
-		log.Printf("Reading command")
+		v.logger(logging.CONTROL).Debug("Reading command")
 		reply, err := v.Transport.ReadControlCommand()
 		if err != nil {
-			log.Printf("Read command err %s", err)
+			v.logger(logging.CONTROL).Warn("Read command failed", "error", err)
 			rerr = err
 		} else {
-
+			v.count_command(RECEIVED, reply.Type)
 		}
 		result = reply
 	})
 	return result, rerr
 }
 
+const SENT = "sent"
+const RECEIVED = "received"
+
+func (v *Pipe) count_command(direction string, cmd_type message.CMD_TYPE) {
+	v.Stats.IncreaseControlCommand(direction, cmd_type.String())
+}
+
 func (v *Pipe) ProcessControlCommand(expectedType message.CMD_TYPE, handler func(cmd message.Command) message.Command) error {
 	var err error
 	v.AtomicExecute(func() {
@@ -64,6 +168,7 @@ func (v *Pipe) ProcessControlCommand(expectedType message.CMD_TYPE, handler func
 		if err != nil {
 			return
 		}
+		v.count_command(RECEIVED, request.Type)
 		if request.Type != expectedType {
 			err = fmt.Errorf("unexpected command type %d <> expected:%d", request.Type, expectedType)
 			response := message.FAIL()
@@ -74,9 +179,10 @@ func (v *Pipe) ProcessControlCommand(expectedType message.CMD_TYPE, handler func
 		var written int
 		written, err = v.Transport.WriteControlCommand(response)
 		if err != nil {
-			log.Printf("Reply error %s", err)
+			v.logger(logging.CONTROL).Warn("Reply failed", "error", err)
 			return
 		}
+		v.count_command(SENT, response.Type)
 		if written > 0 {
 			err = nil
 		} else {
@@ -85,24 +191,30 @@ func (v *Pipe) ProcessControlCommand(expectedType message.CMD_TYPE, handler func
 	})
 	return err
 }
-func NewPipe(iface *water.Interface, transport transport.Transport, routes []string, stats *stats.GlobalStats) (*Pipe, error) {
-	file, ok := iface.ReadWriteCloser.(*os.File)
-	if !ok {
-		return nil, fmt.Errorf("water.Interface %v is does not have a valid file descriptor", iface)
-	}
+func NewPipe(iface Device, transport transport.Transport, routes []string, stats *stats.GlobalStats) (*Pipe, error) {
 	return &Pipe{
-		Iface:     iface,
-		File:      file,
-		Transport: transport,
-		FailFlag:  false,
-		Mutex:     new(sync.Mutex),
-		Routes:    routes,
-		Stats:     stats,
+		Iface:         iface,
+		Transport:     transport,
+		FailFlag:      false,
+		Mutex:         new(sync.Mutex),
+		Routes:        routes,
+		Stats:         stats,
+		EchoInterval:  5 * time.Second,
+		EchoFailLimit: 3,
+		done:          make(chan struct{}),
+		fail_once:     new(sync.Once),
+		goodbye:       make(chan struct{}),
+		echo:          new_echo_state(),
+		flows:         new_flow_table(),
+		replaced:      make(map[string]common.KernelRoute),
 	}, nil
 }
 
 func (v *Pipe) Fail() {
 	v.FailFlag = true
+	v.fail_once.Do(func() {
+		close(v.done)
+	})
 }
 
 func (v *Pipe) Close() error {
@@ -113,10 +225,20 @@ func (v *Pipe) Failed() bool {
 	return v.FailFlag
 }
 
+// HandshakeError reasons of the session setup done by the pipe
+const REASON_ROUTES = "routes"
+const REASON_MTU = "mtu"
+const REASON_ADDRESS = "address"
+const REASON_PUSH = "push"
+
 func (v *Pipe) Run(ctx context.Context, is_server bool) error {
+	v.peer_name = v.Transport.PeerName()
+	v.peer = v.Stats.Peer(v.peer_name)
 	request_func := func() error {
-		routes_join := strings.Join(v.Routes, ";")
-		log.Printf("Requesting to route [%s]", routes_join)
+		announced := v.Announced()
+		routes_join := strings.Join(announced, ";")
+		v.logger(logging.ROUTES).Info("Requesting routes", "count", len(announced))
+		v.logger(logging.ROUTES).Debug("Requested routes", "routes", routes_join)
 		my_request, err := message.WrapCommand(message.CMD_SUBNET_UPDATE, []byte(routes_join))
 		if err != nil {
 			return err
@@ -126,121 +248,548 @@ func (v *Pipe) Run(ctx context.Context, is_server bool) error {
 			return err
 		}
 		if response.IsFail() {
-			log.Printf("Server didn't accept my routes")
+			v.logger(logging.ROUTES).Error("Peer didn't accept my routes")
 			return fmt.Errorf("server didn't accept my routes")
 		} else if response.IsOK() {
-			log.Printf("Server said OK")
+			v.logger(logging.ROUTES).Debug("Peer accepted my routes")
 		} else {
-			log.Printf("Server said %d", response.Type)
+			v.logger(logging.ROUTES).Warn("Unexpected route reply", "type", response.Type)
 		}
 		return nil
 	}
 
 	response_func := func() error {
 		return v.ProcessControlCommand(message.CMD_SUBNET_UPDATE, func(x message.Command) message.Command {
-			log.Printf("Received route request: [%s]", string(x.Data))
 			route_string := string(x.Data)
 			array := common.ToArray(route_string)
+			v.logger(logging.ROUTES).Info("Received route request", "count", len(array))
+			v.logger(logging.ROUTES).Debug("Received routes", "routes", route_string)
 			for _, next := range array {
-				if !common.AddRoute(v.Iface.Name(), next) {
-					log.Printf("Unable to add route next due to error: %s", next)
+				if !v.permits_route(next) {
+					continue
+				}
+				if err := v.AddRoute(next); errors.Is(err, ErrRouteSkipped) {
+					continue
+				} else if err != nil {
+					v.logger(logging.ROUTES).Error("Unable to add route", "route", next, "error", err)
 					return message.FAIL()
 				}
 			}
-			log.Printf("Saying OK")
 			return message.OK()
 		})
 	}
+	if is_server {
+		if err := v.push_address(); err != nil {
+			return transport.NewHandshakeError(REASON_ADDRESS, err)
+		}
+		if err := v.push_config(); err != nil {
+			return transport.NewHandshakeError(REASON_PUSH, err)
+		}
+	} else {
+		if err := v.accept_address(); err != nil {
+			return transport.NewHandshakeError(REASON_ADDRESS, err)
+		}
+		if err := v.accept_config(); err != nil {
+			return transport.NewHandshakeError(REASON_PUSH, err)
+		}
+	}
 	if is_server {
 		var err1, err2 error
 		err1 = request_func()
 		err2 = response_func()
 		if err1 != nil || err2 != nil {
-			return errors.New("routes setup issue")
+			v.withdraw_routes()
+			return transport.NewHandshakeError(REASON_ROUTES, errors.Join(err1, err2))
 		}
 	} else {
 		var err1, err2 error
 		err1 = response_func()
 		err2 = request_func()
 		if err1 != nil || err2 != nil {
-			return errors.New("routes setup issue")
+			v.withdraw_routes()
+			return transport.NewHandshakeError(REASON_ROUTES, errors.Join(err1, err2))
 		}
 	}
-	log.Printf("Routes setup complete")
+	v.logger(logging.ROUTES).Info("Routes setup complete")
+	if err := v.negotiate_mtu(is_server); err != nil {
+		v.withdraw_routes()
+		return transport.NewHandshakeError(REASON_MTU, err)
+	}
+	if v.Filter != nil {
+		v.SetFilter(v.Filter)
+	}
+	started := time.Now()
+	v.started.Store(&started)
+	// the loops outlive ctx while the session is shut down
+	loops, stop_loops := context.WithCancel(context.Background())
+	defer stop_loops()
 	wg := new(sync.WaitGroup)
-	wg.Add(2)
-	go v.file_to_transport(ctx, wg)
-	go v.transport_to_file(ctx, wg)
-	log.Printf("Link UP!")
+	wg.Add(3)
+	if v.Hub != nil {
+		v.outbound = make(chan []byte, HUB_QUEUE)
+		wg.Add(1)
+		go v.queue_to_transport(loops, wg)
+		v.Hub.attach(v)
+	} else {
+		wg.Add(1)
+		go v.file_to_transport(loops, wg)
+	}
+	go v.transport_to_file(loops, wg)
+	go v.control_loop(loops, wg)
+	go v.keepalive(loops, wg)
+	if !is_server {
+		v.apply_push()
+	}
+	v.start_forwards(loops)
+	v.logger(logging.PIPER).Info("Link UP!", "peer", v.Transport.PeerName(), "remote", v.Transport.RemoteAddr(), "mtu", v.MTU())
+	v.Hooks.Fire(v.event(hooks.EVENT_UP, ""))
+	select {
+	case <-ctx.Done():
+		v.shutdown(transport.ShutdownReason(context.Cause(ctx)))
+	case <-v.done:
+		v.Transport.Close()
+	}
+	if v.Hub != nil {
+		v.Hub.detach(v)
+	}
+	stop_loops()
 	wg.Wait()
+	v.close_forwards()
+	v.revert_push()
+	v.withdraw_routes()
+	v.Hooks.Fire(v.event(hooks.EVENT_DOWN, ""))
+	return nil
+}
+
+// MTU is the tunnel MTU agreed with the peer, 0 during setup
+func (v *Pipe) MTU() int {
+	return int(v.mtu.Load())
+}
+
+// Started is when the session was established, zero during setup
+func (v *Pipe) Started() time.Time {
+	if started := v.started.Load(); started != nil {
+		return *started
+	}
+	return time.Time{}
+}
+
+// event describes the session for the hooks
+func (v *Pipe) event(name string, route string) hooks.Event {
+	return hooks.Event{
+		Name:          name,
+		Session:       v.Session,
+		Peer:          v.peer_name,
+		RemoteAddress: v.Transport.RemoteAddr(),
+		MTU:           v.MTU(),
+		Route:         route,
+		Routes:        v.InstalledRoutes(),
+	}
+}
+
+// AddRoute routes cidr into the tunnel and remembers it as installed
+func (v *Pipe) AddRoute(cidr string) error {
+	if v.Hub != nil {
+		if err := v.Hub.claim(v, cidr); err != nil {
+			return err
+		}
+	}
+	replaced, err := v.install_route(cidr)
+	if err != nil {
+		if v.Hub != nil {
+			v.Hub.release(v, cidr)
+		}
+		return err
+	}
+	v.routes_mutex.Lock()
+	v.installed = append(v.installed, cidr)
+	if replaced != nil {
+		v.replaced[cidr] = *replaced
+	}
+	if v.Hub != nil {
+		v.Hub.add(v, cidr)
+	}
+	v.count_routes()
+	v.routes_mutex.Unlock()
+	v.Hooks.Fire(v.event(hooks.EVENT_ROUTE_ADD, cidr))
+	return nil
+}
+
+// install_route adds cidr to the routing table of the host, returns the route it replaced
+func (v *Pipe) install_route(cidr string) (*common.KernelRoute, error) {
+	// a userspace device sends everything into the tunnel, the routes are only recorded
+	if _, ok := v.userspace(); ok {
+		return nil, nil
+	}
+	replaced, err := v.check_conflict(cidr)
+	if err != nil {
+		return nil, err
+	}
+	add := common.AddRoute
+	if replaced != nil {
+		add = common.ReplaceRoute
+	}
+	if !add(v.Iface.Name(), cidr) {
+		return nil, fmt.Errorf("unable to add route %s dev %s", cidr, v.Iface.Name())
+	}
+	return replaced, nil
+}
+
+// DelRoute removes a route installed by AddRoute
+func (v *Pipe) DelRoute(cidr string) error {
+	if err := v.del_route(cidr); err != nil {
+		return err
+	}
+	v.Hooks.Fire(v.event(hooks.EVENT_ROUTE_DEL, cidr))
+	return nil
+}
+
+func (v *Pipe) del_route(cidr string) error {
+	v.routes_mutex.Lock()
+	defer v.routes_mutex.Unlock()
+	if !slices.Contains(v.installed, cidr) {
+		return fmt.Errorf("route %s is not installed by this session", cidr)
+	}
+	if _, ok := v.userspace(); !ok && !common.DelRoute(v.Iface.Name(), cidr) {
+		return fmt.Errorf("unable to delete route %s dev %s", cidr, v.Iface.Name())
+	}
+	v.installed = slices.DeleteFunc(v.installed, func(next string) bool {
+		return next == cidr
+	})
+	if replaced, ok := v.replaced[cidr]; ok {
+		delete(v.replaced, cidr)
+		v.restore_route(cidr, replaced)
+	}
+	if v.Hub != nil {
+		v.Hub.remove(v, cidr)
+	}
+	v.count_routes()
+	return nil
+}
+
+// count_routes records the installed routes, of all sessions when they share a hub
+func (v *Pipe) count_routes() {
+	if v.Hub != nil {
+		v.Hub.count_routes()
+		return
+	}
+	v.Stats.SetRoutes(len(v.installed))
+}
+
+// InstalledRoutes lists the routes this session added into the tunnel
+func (v *Pipe) InstalledRoutes() []string {
+	v.routes_mutex.Lock()
+	defer v.routes_mutex.Unlock()
+	return slices.Clone(v.installed)
+}
+
+// proposed_mtu is the largest MTU this side supports: -mtu, capped by the frame buffers of the transport
+func (v *Pipe) proposed_mtu() int {
+	mtu := v.LocalMTU
+	if mtu <= 0 {
+		mtu = DEFAULT_MTU
+	}
+	if limit := v.Transport.MaxPayload(); mtu > limit {
+		v.logger(logging.PIPER).Warn("MTU exceeds transport payload", "mtu", mtu, "using", limit)
+		mtu = limit
+	}
+	return mtu
+}
+
+// negotiate_mtu agrees on the smaller of both proposals and applies it to the TUN device. This is a handshake of
+// the frame buffer sizes and settings of both sides, not a path MTU discovery: QUIC handles the path.
+// Server proposes, client answers with the agreed value
+func (v *Pipe) negotiate_mtu(is_server bool) error {
+	local := v.proposed_mtu()
+	var agreed int
+	if is_server {
+		response, err := v.ExecuteControlCommand(message.MTU(local))
+		if err != nil {
+			return err
+		}
+		if response.Type != message.CMD_MTU {
+			return fmt.Errorf("unexpected mtu reply type %d", response.Type)
+		}
+		agreed, err = response.MTUValue()
+		if err != nil {
+			return err
+		}
+		if agreed > local {
+			return fmt.Errorf("peer agreed on mtu %d larger than proposed %d", agreed, local)
+		}
+	} else {
+		err := v.ProcessControlCommand(message.CMD_MTU, func(x message.Command) message.Command {
+			remote, err := x.MTUValue()
+			if err == nil && remote < MIN_MTU {
+				err = fmt.Errorf("mtu %d below %d", remote, MIN_MTU)
+			}
+			if err != nil {
+				v.logger(logging.CONTROL).Warn("Bad mtu proposal", "error", err)
+				return message.FAIL()
+			}
+			agreed = min(local, remote)
+			return message.MTU(agreed)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	v.logger(logging.PIPER).Info("Tunnel MTU agreed", "mtu", agreed, "local", local)
+	// a shared device keeps the MTU of the hub, larger packets are answered by too_big
+	if device, ok := v.userspace(); ok {
+		if err := device.SetMTU(agreed); err != nil {
+			return err
+		}
+	} else if v.Hub == nil && !common.SetMTU(v.Iface.Name(), agreed) {
+		return fmt.Errorf("unable to set mtu %d on %s", agreed, v.Iface.Name())
+	}
+	v.mtu.Store(int32(agreed))
 	return nil
 }
 
+// clamp_mss rewrites the MSS option of TCP SYN and SYN-ACK packets when clamping is enabled
+func (v *Pipe) clamp_mss(data []byte) {
+	if v.MSSClamp == 0 {
+		return
+	}
+	header, err := packet.Parse(data)
+	if err != nil || header.Protocol != packet.PROTO_TCP {
+		return
+	}
+	mss := v.MSSClamp
+	if mss == MSS_CLAMP_AUTO {
+		mss = packet.MSSForMTU(v.MTU(), header.Version)
+	}
+	packet.ClampMSS(data, header, mss)
+}
+
+// too_big drops a packet larger than the tunnel MTU and answers the sender with
+// ICMP Fragmentation Needed / Packet Too Big so it can lower its path MTU
+func (v *Pipe) too_big(data []byte) {
+	header, err := packet.Parse(data)
+	if err != nil {
+		return
+	}
+	reply, err := packet.TooBig(data, header, v.MTU())
+	if err != nil {
+		return
+	}
+	if _, err := v.Iface.Write(reply); err != nil {
+		v.logger(logging.PIPER).Warn("Write ICMP too big to TUN failed", "error", err)
+	}
+}
+
+// SendControlCommand writes a command on the control stream without waiting for a reply.
+// Only valid after the route setup is complete, replies are handled by control_loop
+func (v *Pipe) SendControlCommand(cmd message.Command) error {
+	var err error
+	v.AtomicExecute(func() {
+		_, err = v.Transport.WriteControlCommand(cmd)
+	})
+	if err == nil {
+		v.count_command(SENT, cmd.Type)
+	}
+	return err
+}
+
+// control_loop reads commands the peer sends after route setup until the control stream breaks
+func (v *Pipe) control_loop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	logger := v.logger(logging.CONTROL)
+	logger.Debug("Control loop started")
+	defer func() {
+		logger.Debug("Control loop ended")
+	}()
+	for {
+		cmd, err := v.Transport.ReadControlCommand()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			default:
+				if v.stopping.Load() {
+					logger.Debug("Control stream closed", "error", err)
+				} else {
+					logger.Warn("Read command failed", "error", err)
+				}
+			}
+			v.Fail()
+			return
+		}
+		v.count_command(RECEIVED, cmd.Type)
+		switch cmd.Type {
+		case message.CMD_ECHO:
+			if err := v.SendControlCommand(message.EchoReply(cmd)); err != nil {
+				logger.Warn("Echo reply failed", "error", err)
+				v.Fail()
+				return
+			}
+		case message.CMD_ECHO_REPLY:
+			v.handle_echo_reply(cmd)
+		case message.CMD_SUBNET_UPDATE:
+			if err := v.handle_subnet_update(cmd); err != nil {
+				logger.Warn("Route update reply failed", "error", err)
+				v.Fail()
+				return
+			}
+		case message.CMD_PUSH:
+			if err := v.handle_push(cmd); err != nil {
+				logger.Warn("Push reply failed", "error", err)
+				v.Fail()
+				return
+			}
+		case message.CMD_FORWARD:
+			if err := v.handle_forward(ctx, cmd); err != nil {
+				logger.Warn("Forward reply failed", "error", err)
+				v.Fail()
+				return
+			}
+		case message.CMD_OK:
+			logger.Debug("Peer applied the update")
+		case message.CMD_FAIL:
+			logger.Warn("Peer failed to apply the update")
+		case message.CMD_GOODBYE:
+			if err := v.handle_goodbye(cmd); err != nil {
+				logger.Warn("Goodbye reply failed", "error", err)
+				v.Fail()
+				return
+			}
+		default:
+			logger.Warn("Ignoring unexpected command", "type", cmd.Type)
+		}
+	}
+}
+
 // Handle a command and give a reply
 func (v *Pipe) file_to_transport(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
-	var tag = "tun dev -> transport"
-	log.Printf("%s started\n", tag)
+	logger := v.logger(logging.PIPER).With("loop", "tun dev -> transport")
+	logger.Debug("Loop started")
 	defer func() {
-		log.Printf("%s ended\n", tag)
+		logger.Debug("Loop ended")
 	}()
-	buffer := make([]byte, 4096)
+	buffer := make([]byte, transport.BUFFER_SIZE)
 	run := true
 	for run {
 		select {
 		case <-ctx.Done():
-			log.Printf("%s Context cancelled\n", tag)
+			logger.Debug("Context cancelled")
 			run = false
 		default:
 			// nothing
 		}
 		if !run {
-			v.Transport.Close()
-			v.Transport.Close()
-			v.Transport.Close()
-			v.Transport.Close()
 			break
 		}
-		v.File.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
-		nread, err := v.File.Read(buffer)
+		if v.stopping.Load() {
+			logger.Debug("Session ending, no more packets from the TUN device")
+			break
+		}
+		v.Iface.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		nread, err := v.Iface.Read(buffer)
 		if err != nil {
 			if os.IsTimeout(err) {
 				if v.Failed() {
-					log.Printf("%s Other party may have failed. Breaking\n", tag)
+					logger.Info("Other party may have failed. Breaking")
 					break
 				}
 				continue
 			}
-			log.Printf("%s Error is %s\n", tag, err)
+			logger.Warn("Read failed", "error", err)
+			v.Stats.IncreaseError(stats.ERROR_TUN_READ)
 			v.Fail()
 			break
 		}
-		//log.Printf("%s Read %d bytes\n", tag, nread)
-		_, err = v.Transport.Write(buffer[:nread])
-		if err != nil {
-			log.Printf("%s Write Transport error: %s\n", tag, err)
+		//logger.Debug("Read", "bytes", nread)
+		if err := v.send(buffer[:nread]); err != nil {
+			logger.Error("Write transport failed", "error", err)
 			v.Fail()
 			break
 		}
-		v.Stats.IncreaseUploadedBytes(uint64(nread))
-		//log.Printf("%s Written %d bytes\n", tag, nwritten)
 	}
 }
 
-func (v *Pipe) transport_to_file(ctx context.Context, wg *sync.WaitGroup) {
+// queue_to_transport writes the packets the hub queued for the session, until ctx is done
+func (v *Pipe) queue_to_transport(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
-	var tag = "transport -> tun dev"
+	logger := v.logger(logging.PIPER).With("loop", "hub queue -> transport")
+	logger.Debug("Loop started")
+	defer func() {
+		logger.Debug("Loop ended")
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case data := <-v.outbound:
+			if v.stopping.Load() {
+				continue
+			}
+			if err := v.send(data); err != nil {
+				logger.Error("Write transport failed", "error", err)
+				v.Fail()
+				return
+			}
+		}
+	}
+}
+
+// enqueue hands a packet to queue_to_transport without waiting, a session that can't keep up
+// doesn't hold back the others. The packet is dropped when the queue is full
+func (v *Pipe) enqueue(data []byte) {
+	select {
+	case v.outbound <- slices.Clone(data):
+	default:
+		v.Stats.IncreaseDropped(stats.DROP_QUEUE_FULL)
+	}
+}
 
-	log.Printf("%s started\n", tag)
+// send writes a packet read from the TUN device, or forwarded by the hub, to the peer.
+// Packets dropped on the way are counted, the error tells the transport is broken
+func (v *Pipe) send(data []byte) error {
+	if !v.permit(data, OUT) {
+		v.Stats.IncreaseDropped(stats.DROP_FILTER)
+		return nil
+	}
+	if !v.within_bandwidth(len(data), OUT) {
+		return nil
+	}
+	if len(data) > v.MTU() {
+		v.Stats.IncreaseDropped(stats.DROP_OVERSIZE)
+		v.too_big(data)
+		return nil
+	}
+	v.clamp_mss(data)
+	v.Capture.Record(v.peer_name, OUT, data)
+	_, err := v.Transport.Write(data)
+	if errors.Is(err, transport.ErrTooLarge) {
+		v.Stats.IncreaseDropped(stats.DROP_OVERSIZE)
+		v.too_big(data)
+		return nil
+	}
+	if err != nil {
+		v.Stats.IncreaseError(stats.ERROR_TRANSPORT_WRITE)
+		v.Stats.IncreaseDropped(stats.DROP_TRANSPORT_CLOSED)
+		return err
+	}
+	v.Stats.IncreaseUploadedBytes(uint64(len(data)))
+	v.Stats.IncreaseUploadedPackets()
+	v.peer.IncreaseUploaded(uint64(len(data)))
+	return nil
+}
+
+func (v *Pipe) transport_to_file(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	logger := v.logger(logging.PIPER).With("loop", "transport -> tun dev")
+	logger.Debug("Loop started")
 	defer func() {
-		log.Printf("%s ended\n", tag)
+		logger.Debug("Loop ended")
 	}()
-	buffer := make([]byte, 4096)
+	buffer := make([]byte, transport.BUFFER_SIZE)
 	run := true
 	for run {
 		select {
 		case <-ctx.Done():
-			log.Printf("%s Context cancelled\n", tag)
+			logger.Debug("Context cancelled")
 			run = false
 		default:
 			// nothing
@@ -252,23 +801,47 @@ func (v *Pipe) transport_to_file(ctx context.Context, wg *sync.WaitGroup) {
 		if err != nil {
 			if os.IsTimeout(err) {
 				if v.Failed() {
-					log.Printf("%s Other party may have failed. Breaking\n", tag)
+					logger.Info("Other party may have failed. Breaking")
 					break
 				}
 				continue
 			}
-			log.Printf("%s Error is %s\n", tag, err)
+			if v.stopping.Load() {
+				logger.Debug("Transport closed", "error", err)
+			} else {
+				logger.Warn("Read failed", "error", err)
+				if err != io.EOF {
+					v.Stats.IncreaseError(stats.ERROR_TRANSPORT_READ)
+				}
+			}
 			v.Fail()
 			break
 		}
-		//log.Printf("%s Read %d bytes\n", tag, nread)
+		//logger.Debug("Read", "bytes", nread)
+		if !v.permit(buffer[:nread], IN) {
+			v.Stats.IncreaseDropped(stats.DROP_FILTER)
+			continue
+		}
+		if !v.within_bandwidth(nread, IN) {
+			continue
+		}
+		v.clamp_mss(buffer[:nread])
+		v.Capture.Record(v.peer_name, IN, buffer[:nread])
+		if v.Hub != nil && v.Hub.forward(v, buffer[:nread]) {
+			v.peer.IncreaseDownloaded(uint64(nread))
+			continue
+		}
 		_, err = v.Iface.Write(buffer[:nread])
 		if err != nil {
-			log.Printf("%s Write TUN error: %s %v\n", tag, err, buffer[:nread])
+			logger.Error("Write TUN failed", "error", err, "size", nread)
+			logger.Debug("Packet not written", "packet", buffer[:nread])
+			v.Stats.IncreaseError(stats.ERROR_TUN_WRITE)
 			v.Fail()
 			break
 		}
 		v.Stats.IncreaseDownloadedBytes(uint64(nread))
-		//log.Printf("%s Written %d bytes\n", tag, nwritten)
+		v.Stats.IncreaseDownloadedPackets()
+		v.peer.IncreaseDownloaded(uint64(nread))
+		//logger.Debug("Written", "bytes", nwritten)
 	}
 }
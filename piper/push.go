@@ -0,0 +1,424 @@
+package piper
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/wushilin/go-vpn/common"
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/message"
+	"github.com/wushilin/go-vpn/stats"
+)
+
+// RoutePolicy decides which routes announced by the peer are installed
+type RoutePolicy interface {
+	Permits(cidr string) bool
+}
+
+// Announced lists the routes this side asks the peer to send into the tunnel: its own address and Routes
+func (v *Pipe) Announced() []string {
+	var result []string
+	if v.Address != "" {
+		prefix, err := netip.ParsePrefix(v.Address)
+		if err == nil {
+			result = append(result, prefix.Addr().String())
+		}
+	}
+	return append(result, v.RequestedRoutes()...)
+}
+
+// RequestedRoutes returns the routes this side asks the peer to send into the tunnel, besides its address
+func (v *Pipe) RequestedRoutes() []string {
+	v.routes_mutex.Lock()
+	defer v.routes_mutex.Unlock()
+	return slices.Clone(v.Routes)
+}
+
+// push_address tells the client which tunnel address to use, PeerAddress or its own when empty
+func (v *Pipe) push_address() error {
+	peer_address := v.PeerAddress()
+	response, err := v.ExecuteControlCommand(message.Address(peer_address))
+	if err != nil {
+		return err
+	}
+	if !response.IsOK() {
+		return fmt.Errorf("peer didn't accept address %s", peer_address)
+	}
+	if peer_address != "" {
+		v.logger(logging.PIPER).Info("Assigned address to peer", "address", peer_address)
+	}
+	return nil
+}
+
+// accept_address replaces the address of the TUN device with the one assigned by the server
+func (v *Pipe) accept_address() error {
+	return v.ProcessControlCommand(message.CMD_ADDRESS, func(x message.Command) message.Command {
+		address := string(x.Data)
+		if address == "" || address == v.Address {
+			return message.OK()
+		}
+		if _, err := netip.ParsePrefix(address); err != nil {
+			v.logger(logging.PIPER).Error("Invalid address assigned by the server", "address", address)
+			return message.FAIL()
+		}
+		if device, ok := v.userspace(); ok {
+			if err := device.SetAddress(address); err != nil {
+				v.logger(logging.PIPER).Error("Failed to set IP Address", "laddr", address, "error", err)
+				return message.FAIL()
+			}
+			v.logger(logging.PIPER).Info("Using address assigned by the server", "laddr", address, "replaced", v.Address)
+			v.Address = address
+			return message.OK()
+		}
+		if v.Address != "" && !common.DelIPAddress(v.Iface.Name(), v.Address) {
+			v.logger(logging.PIPER).Warn("Failed to remove IP Address", "laddr", v.Address)
+		}
+		if !common.SetIPAddress(v.Iface.Name(), address) {
+			v.logger(logging.PIPER).Error("Failed to set IP Address", "laddr", address)
+			return message.FAIL()
+		}
+		v.logger(logging.PIPER).Info("Using address assigned by the server", "laddr", address, "replaced", v.Address)
+		v.Address = address
+		return message.OK()
+	})
+}
+
+// SetRoutes replaces the routes this side announces. A running session sends them to the peer,
+// which installs the new ones and withdraws the ones no longer announced
+func (v *Pipe) SetRoutes(routes []string) error {
+	v.routes_mutex.Lock()
+	v.Routes = routes
+	v.routes_mutex.Unlock()
+	if v.Started().IsZero() {
+		return nil
+	}
+	update, err := message.WrapCommand(message.CMD_SUBNET_UPDATE, []byte(strings.Join(v.Announced(), ";")))
+	if err != nil {
+		return err
+	}
+	v.logger(logging.ROUTES).Info("Updating routes of the peer", "count", len(v.Announced()))
+	return v.SendControlCommand(update)
+}
+
+// AnnounceRoute asks the peer to send cidr into the tunnel as well, the runtime counterpart of Routes
+func (v *Pipe) AnnounceRoute(cidr string) error {
+	if _, err := parse_route(cidr); err != nil {
+		return err
+	}
+	routes := v.RequestedRoutes()
+	if slices.Contains(routes, cidr) {
+		return fmt.Errorf("route %s is already announced", cidr)
+	}
+	return v.SetRoutes(append(routes, cidr))
+}
+
+// WithdrawRoute asks the peer to stop sending cidr into the tunnel
+func (v *Pipe) WithdrawRoute(cidr string) error {
+	routes := v.RequestedRoutes()
+	if !slices.Contains(routes, cidr) {
+		return fmt.Errorf("route %s is not announced by this session", cidr)
+	}
+	return v.SetRoutes(slices.DeleteFunc(routes, func(next string) bool {
+		return next == cidr
+	}))
+}
+
+// handle_subnet_update applies the routes the peer announces during the session
+func (v *Pipe) handle_subnet_update(cmd message.Command) error {
+	announced := common.ToArray(string(cmd.Data))
+	v.logger(logging.ROUTES).Info("Received route update", "count", len(announced))
+	reply := message.OK()
+	for _, cidr := range v.InstalledRoutes() {
+		if !slices.Contains(announced, cidr) {
+			if err := v.DelRoute(cidr); err != nil {
+				v.logger(logging.ROUTES).Error("Unable to withdraw route", "route", cidr, "error", err)
+				reply = message.FAIL()
+			}
+		}
+	}
+	installed := v.InstalledRoutes()
+	for _, cidr := range announced {
+		if slices.Contains(installed, cidr) || !v.permits_route(cidr) {
+			continue
+		}
+		if err := v.AddRoute(cidr); errors.Is(err, ErrRouteSkipped) {
+			continue
+		} else if err != nil {
+			v.logger(logging.ROUTES).Error("Unable to add route", "route", cidr, "error", err)
+			reply = message.FAIL()
+		}
+	}
+	return v.SendControlCommand(reply)
+}
+
+// permits_route is false when the route policy doesn't allow the peer to announce cidr
+func (v *Pipe) permits_route(cidr string) bool {
+	v.routes_mutex.Lock()
+	policy := v.route_policy
+	v.routes_mutex.Unlock()
+	if policy == nil || policy.Permits(cidr) {
+		return true
+	}
+	v.logger(logging.ROUTES).Warn("Route not allowed, skipped", "route", cidr, "peer", v.peer_name)
+	return false
+}
+
+// SetRoutePolicy restricts the routes the peer may announce, nil allows all. Installed routes
+// the policy doesn't allow are withdrawn
+func (v *Pipe) SetRoutePolicy(policy RoutePolicy) {
+	v.routes_mutex.Lock()
+	v.route_policy = policy
+	v.routes_mutex.Unlock()
+	for _, cidr := range v.InstalledRoutes() {
+		if !v.permits_route(cidr) {
+			if err := v.DelRoute(cidr); err != nil {
+				v.logger(logging.ROUTES).Warn("Unable to withdraw route", "route", cidr, "error", err)
+			}
+		}
+	}
+}
+
+// SetBandwidth limits the bytes per second in each direction, 0 is unlimited. The limiters are only
+// replaced when the rate changes, new ones start with a full burst
+func (v *Pipe) SetBandwidth(rate uint64) {
+	if v.limit_in.Load().bandwidth() == rate && v.limit_out.Load().bandwidth() == rate {
+		return
+	}
+	v.limit_in.Store(new_limiter(rate))
+	v.limit_out.Store(new_limiter(rate))
+}
+
+// within_bandwidth counts the packet as dropped when it exceeds the bandwidth of its direction
+func (v *Pipe) within_bandwidth(size int, direction DIRECTION) bool {
+	limit := v.limit_out.Load()
+	if direction == IN {
+		limit = v.limit_in.Load()
+	}
+	if limit.allow(size) {
+		return true
+	}
+	v.Stats.IncreaseDropped(stats.DROP_BANDWIDTH)
+	return false
+}
+
+// Routes replacing the default route without removing it, so it is still there when the session ends
+var DEFAULT_ROUTES = []string{"0.0.0.0/1", "128.0.0.0/1"}
+var DEFAULT_ROUTES6 = []string{"::/1", "8000::/1"}
+
+// PushConfig is what the server configures on a client besides the routes and the address
+type PushConfig struct {
+	// Name servers and search domains of the client while connected
+	DNS    []string
+	Search []string
+	// Send all traffic of the client into the tunnel
+	DefaultRoute bool
+}
+
+// Encode writes the configuration as lines of `dns <server>`, `search <domain>` and `default-route`
+func (v PushConfig) Encode() string {
+	var lines []string
+	for _, server := range v.DNS {
+		lines = append(lines, "dns "+server)
+	}
+	for _, domain := range v.Search {
+		lines = append(lines, "search "+domain)
+	}
+	if v.DefaultRoute {
+		lines = append(lines, "default-route")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func DecodePush(value string) (PushConfig, error) {
+	var result PushConfig
+	for _, line := range strings.Split(value, "\n") {
+		tokens := strings.Fields(line)
+		if len(tokens) == 0 {
+			continue
+		}
+		switch {
+		case tokens[0] == "dns" && len(tokens) == 2:
+			if _, err := netip.ParseAddr(tokens[1]); err != nil {
+				return result, fmt.Errorf("invalid dns server %s", tokens[1])
+			}
+			result.DNS = append(result.DNS, tokens[1])
+		case tokens[0] == "search" && len(tokens) == 2:
+			result.Search = append(result.Search, tokens[1])
+		case tokens[0] == "default-route" && len(tokens) == 1:
+			result.DefaultRoute = true
+		default:
+			// from a newer server
+			logging.For(logging.CONTROL).Warn("Ignoring unknown push", "line", line)
+		}
+	}
+	return result, nil
+}
+
+// Pushed is the configuration pushed to the client, or received from the server
+func (v *Pipe) Pushed() PushConfig {
+	v.push_mutex.Lock()
+	defer v.push_mutex.Unlock()
+	return v.push
+}
+
+// SetProfile records the profile applied to the session and the tunnel address it assigns to the client
+func (v *Pipe) SetProfile(name string, peer_address string) {
+	v.push_mutex.Lock()
+	defer v.push_mutex.Unlock()
+	v.profile = name
+	v.peer_address = peer_address
+}
+
+// Profile is the name of the profile applied to the session, shown in the status
+func (v *Pipe) Profile() string {
+	v.push_mutex.Lock()
+	defer v.push_mutex.Unlock()
+	return v.profile
+}
+
+// PeerAddress is the tunnel address assigned to the client, empty lets the client keep its own
+func (v *Pipe) PeerAddress() string {
+	v.push_mutex.Lock()
+	defer v.push_mutex.Unlock()
+	return v.peer_address
+}
+
+func (v *Pipe) set_pushed(config PushConfig) {
+	v.push_mutex.Lock()
+	defer v.push_mutex.Unlock()
+	v.push = config
+}
+
+// push_config sends the configuration to the client
+func (v *Pipe) push_config() error {
+	response, err := v.ExecuteControlCommand(message.Push(v.Pushed().Encode()))
+	if err != nil {
+		return err
+	}
+	if !response.IsOK() {
+		return fmt.Errorf("peer didn't accept the pushed configuration")
+	}
+	return nil
+}
+
+// accept_config receives the configuration the server pushes, applied once the session is up
+func (v *Pipe) accept_config() error {
+	return v.ProcessControlCommand(message.CMD_PUSH, func(x message.Command) message.Command {
+		config, err := DecodePush(string(x.Data))
+		if err != nil {
+			v.logger(logging.CONTROL).Error("Invalid configuration pushed by the server", "error", err)
+			return message.FAIL()
+		}
+		v.set_pushed(config)
+		return message.OK()
+	})
+}
+
+// SetPush replaces the configuration pushed to the client. A running session sends it right away
+func (v *Pipe) SetPush(config PushConfig) error {
+	v.set_pushed(config)
+	if v.Started().IsZero() {
+		return nil
+	}
+	v.logger(logging.CONTROL).Info("Updating configuration of the peer")
+	return v.SendControlCommand(message.Push(config.Encode()))
+}
+
+// handle_push applies a configuration the server pushes during the session
+func (v *Pipe) handle_push(cmd message.Command) error {
+	config, err := DecodePush(string(cmd.Data))
+	if err != nil {
+		v.logger(logging.CONTROL).Error("Invalid configuration pushed by the server", "error", err)
+		return v.SendControlCommand(message.FAIL())
+	}
+	v.revert_push()
+	v.set_pushed(config)
+	v.apply_push()
+	return v.SendControlCommand(message.OK())
+}
+
+// apply_push configures the client as pushed by the server: default route and DNS
+func (v *Pipe) apply_push() {
+	logger := v.logger(logging.ROUTES)
+	push := v.Pushed()
+	if device, ok := v.userspace(); ok {
+		// all its traffic goes into the tunnel already
+		if len(push.DNS) > 0 && v.DNSMode != common.DNS_OFF {
+			logger.Info("Using DNS of the server", "servers", push.DNS)
+			device.SetDNS(push.DNS)
+			v.revert_dns = func() {
+				device.SetDNS(nil)
+			}
+		}
+		return
+	}
+	if push.DefaultRoute || v.FullTunnel {
+		if err := v.set_default_route(); err != nil {
+			logger.Error("Unable to route all traffic into the tunnel", "error", err)
+		}
+	}
+	if len(push.DNS) > 0 && v.DNSMode != common.DNS_OFF {
+		revert, err := common.SetDNS(v.DNSMode, v.Iface.Name(), push.DNS, push.Search)
+		if err != nil {
+			logger.Error("Unable to set DNS", "error", err, "mode", v.DNSMode)
+		} else {
+			logger.Info("Using DNS of the server", "servers", push.DNS, "search", push.Search)
+			v.revert_dns = revert
+		}
+	}
+}
+
+// set_default_route keeps the server reachable through the current gateway and sends everything else into the tunnel
+func (v *Pipe) set_default_route() error {
+	server, err := netip.ParseAddrPort(v.Transport.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	address := server.Addr().Unmap().String()
+	gateway, device, ok := common.RouteTo(address)
+	if !ok {
+		return fmt.Errorf("no route to the server %s", address)
+	}
+	// a host route of the system already keeps the server reachable, and is not ours to remove
+	if !common.HasHostRoute(address) {
+		if !common.AddHostRoute(address, gateway, device) {
+			return fmt.Errorf("unable to pin the route to the server %s", address)
+		}
+		v.pinned = address
+	}
+	for _, cidr := range DEFAULT_ROUTES {
+		if !common.AddRoute(v.Iface.Name(), cidr) {
+			return fmt.Errorf("unable to add route %s dev %s", cidr, v.Iface.Name())
+		}
+		v.default_routes = append(v.default_routes, cidr)
+	}
+	// IPv6 may be disabled on the host, there is nothing to leak then
+	for _, cidr := range DEFAULT_ROUTES6 {
+		if !common.AddRoute(v.Iface.Name(), cidr) {
+			v.logger(logging.ROUTES).Warn("Unable to route IPv6 traffic into the tunnel", "route", cidr)
+			continue
+		}
+		v.default_routes = append(v.default_routes, cidr)
+	}
+	v.logger(logging.ROUTES).Info("Routing all traffic into the tunnel", "server", address, "gateway", gateway, "device", device)
+	return nil
+}
+
+// revert_push undoes apply_push
+func (v *Pipe) revert_push() {
+	if v.revert_dns != nil {
+		v.revert_dns()
+		v.revert_dns = nil
+	}
+	for _, cidr := range v.default_routes {
+		common.DelRoute(v.Iface.Name(), cidr)
+	}
+	v.default_routes = nil
+	if v.pinned != "" {
+		common.DelHostRoute(v.pinned)
+		v.pinned = ""
+	}
+}
@@ -0,0 +1,63 @@
+package piper
+
+import (
+	"time"
+
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/message"
+	"github.com/wushilin/go-vpn/transport"
+)
+
+// Default time given to the peer to answer GOODBYE. Packets in flight are still delivered meanwhile
+const DRAIN_TIMEOUT = 2 * time.Second
+
+// shutdown ends the session on purpose: stop reading the TUN device, tell the peer why, let the packets
+// in flight arrive until the peer answers (at most DrainTimeout), withdraw the routes and close the
+// connection with reason as application error code
+func (v *Pipe) shutdown(reason transport.CLOSE_REASON) {
+	logger := v.logger(logging.PIPER)
+	logger.Info("Ending the session", "reason", reason)
+	v.stopping.Store(true)
+	if err := v.SendControlCommand(message.Goodbye(reason.String())); err != nil {
+		logger.Warn("Unable to send goodbye", "error", err)
+	} else {
+		timeout := v.DrainTimeout
+		if timeout <= 0 {
+			timeout = DRAIN_TIMEOUT
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-v.goodbye:
+			logger.Debug("Peer answered goodbye")
+		case <-v.done:
+		case <-timer.C:
+			logger.Warn("Peer didn't answer goodbye in time", "timeout", timeout)
+		}
+	}
+	v.withdraw_routes()
+	v.Fail()
+	v.Transport.CloseWithReason(reason)
+}
+
+// handle_goodbye takes a GOODBYE as the answer to ours, or answers the peer ending the session.
+// The peer closes the connection once it has the answer
+func (v *Pipe) handle_goodbye(cmd message.Command) error {
+	if v.stopping.Swap(true) {
+		v.goodbye_once.Do(func() {
+			close(v.goodbye)
+		})
+		return nil
+	}
+	v.logger(logging.PIPER).Info("Peer is ending the session", "reason", string(cmd.Data))
+	return v.SendControlCommand(message.Goodbye(string(cmd.Data)))
+}
+
+// withdraw_routes removes the routes this session installed
+func (v *Pipe) withdraw_routes() {
+	for _, cidr := range v.InstalledRoutes() {
+		if err := v.DelRoute(cidr); err != nil {
+			v.logger(logging.ROUTES).Warn("Unable to withdraw route", "route", cidr, "error", err)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package profile
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Profile used for clients without a profile of their own
+const DEFAULT_PROFILE = "default"
+
+// Extension of the profile files
+const EXTENSION = ".conf"
+
+var DAYS = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Profile holds the settings of the clients with one certificate identity
+type Profile struct {
+	// File name without extension, the identity
+	Name    string
+	Enabled bool
+	// Tunnel address (CIDR) the client must use. Empty lets the client use its -laddr
+	Address string
+	// Routes pushed to the client, in addition to the routes of the server
+	Push []string
+	// Networks the client may announce. Empty allows any
+	Allow []netip.Prefix
+	// Bytes per second in each direction. 0 is unlimited
+	Bandwidth uint64
+	// When the client may be connected, local time. Empty is always
+	Hours []Hours
+	// Name servers and search domains pushed to the client, replacing the ones of the server flags when set
+	DNS    []string
+	Search []string
+	// Overrides -push-default-route when set
+	DefaultRoute *bool
+}
+
+// Hours is a daily time window on some days of the week. From after To spans midnight
+type Hours struct {
+	// Indexed by time.Weekday
+	Days [7]bool
+	From time.Duration
+	To   time.Duration
+}
+
+func (v Hours) contains(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	today := now.Weekday()
+	if v.From <= v.To {
+		return v.Days[today] && offset >= v.From && offset < v.To
+	}
+	// the part before midnight belongs to the day the window started
+	yesterday := (today + 6) % 7
+	return (v.Days[today] && offset >= v.From) || (v.Days[yesterday] && offset < v.To)
+}
+
+// Open is true when now is within the allowed hours
+func (v *Profile) Open(now time.Time) bool {
+	if len(v.Hours) == 0 {
+		return true
+	}
+	for _, next := range v.Hours {
+		if next.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits is true when the client may announce cidr, a network or a single address
+func (v *Profile) Permits(cidr string) bool {
+	if len(v.Allow) == 0 {
+		return true
+	}
+	prefix, err := parse_prefix(cidr)
+	if err != nil {
+		return false
+	}
+	if v.Address != "" {
+		if address, err := netip.ParsePrefix(v.Address); err == nil && prefix == netip.PrefixFrom(address.Addr(), address.Addr().BitLen()) {
+			return true
+		}
+	}
+	for _, allowed := range v.Allow {
+		if allowed.Bits() <= prefix.Bits() && allowed.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Profiles are the profiles of a directory, one file per identity
+type Profiles struct {
+	Dir      string
+	Profiles map[string]*Profile
+}
+
+// Lookup returns the profile of the first identity having one, the default profile otherwise.
+// nil when there is neither
+func (v *Profiles) Lookup(identities []string) *Profile {
+	for _, identity := range identities {
+		if result, ok := v.Profiles[identity]; ok {
+			return result
+		}
+	}
+	return v.Profiles[DEFAULT_PROFILE]
+}
+
+// Load reads every <identity>.conf file of dir. The identity is the common name or a subject alternative
+// name of the client certificate. Each line is one of
+//
+//	enabled yes|no
+//	address <tunnel address in CIDR notation>
+//	push <route>
+//	allow <prefix>
+//	bandwidth <bytes per second, e.g. 10MB>
+//	hours [<day>[-<day>][,...]] <hh:mm>-<hh:mm>
+//	dns <name server>
+//	search <domain>
+//	default-route yes|no
+//
+// push, allow, hours, dns and search may be repeated. Days are sun, mon, tue, wed, thu, fri and sat, all by default
+func Load(dir string) (*Profiles, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+EXTENSION))
+	if err != nil {
+		return nil, err
+	}
+	result := &Profiles{
+		Dir:      dir,
+		Profiles: make(map[string]*Profile),
+	}
+	for _, file := range files {
+		profile, err := load_file(file)
+		if err != nil {
+			return nil, err
+		}
+		result.Profiles[profile.Name] = profile
+	}
+	return result, nil
+}
+
+func load_file(path string) (*Profile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	result := &Profile{
+		Name:    strings.TrimSuffix(filepath.Base(path), EXTENSION),
+		Enabled: true,
+	}
+	scanner := bufio.NewScanner(file)
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		line := scanner.Text()
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) == 0 {
+			continue
+		}
+		if err := result.parse(tokens); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line_number, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (v *Profile) parse(tokens []string) error {
+	keyword := tokens[0]
+	values := tokens[1:]
+	if keyword != "hours" && len(values) != 1 {
+		return fmt.Errorf("%s requires one value", keyword)
+	}
+	switch keyword {
+	case "enabled", "default-route":
+		if values[0] != "yes" && values[0] != "no" {
+			return fmt.Errorf("%s requires yes or no", keyword)
+		}
+		value := values[0] == "yes"
+		if keyword == "enabled" {
+			v.Enabled = value
+		} else {
+			v.DefaultRoute = &value
+		}
+	case "dns":
+		if _, err := netip.ParseAddr(values[0]); err != nil {
+			return fmt.Errorf("invalid name server %s", values[0])
+		}
+		v.DNS = append(v.DNS, values[0])
+	case "search":
+		v.Search = append(v.Search, values[0])
+	case "address":
+		if _, err := netip.ParsePrefix(values[0]); err != nil {
+			return fmt.Errorf("invalid address %s, expect CIDR notation", values[0])
+		}
+		v.Address = values[0]
+	case "push":
+		if _, err := parse_prefix(values[0]); err != nil {
+			return err
+		}
+		v.Push = append(v.Push, values[0])
+	case "allow":
+		prefix, err := parse_prefix(values[0])
+		if err != nil {
+			return err
+		}
+		v.Allow = append(v.Allow, prefix)
+	case "bandwidth":
+		bandwidth, err := humanize.ParseBytes(values[0])
+		if err != nil {
+			return fmt.Errorf("invalid bandwidth %s", values[0])
+		}
+		v.Bandwidth = bandwidth
+	case "hours":
+		hours, err := parse_hours(values)
+		if err != nil {
+			return err
+		}
+		v.Hours = append(v.Hours, hours)
+	default:
+		return fmt.Errorf("unknown keyword %s", keyword)
+	}
+	return nil
+}
+
+// parse_prefix reads a network or a single address
+func parse_prefix(value string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix %s", value)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parse_hours(values []string) (Hours, error) {
+	var result Hours
+	if len(values) < 1 || len(values) > 2 {
+		return result, fmt.Errorf("hours requires [days] hh:mm-hh:mm")
+	}
+	if len(values) == 1 {
+		for day := range result.Days {
+			result.Days[day] = true
+		}
+	} else {
+		for _, days := range strings.Split(values[0], ",") {
+			from, to, _ := strings.Cut(days, "-")
+			first := slices.Index(DAYS, from)
+			last := first
+			if to != "" {
+				last = slices.Index(DAYS, to)
+			}
+			if first < 0 || last < 0 {
+				return result, fmt.Errorf("invalid days %s", days)
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				result.Days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+	}
+	from, to, ok := strings.Cut(values[len(values)-1], "-")
+	if !ok {
+		return result, fmt.Errorf("invalid hours %s, expect hh:mm-hh:mm", values[len(values)-1])
+	}
+	var err error
+	if result.From, err = parse_time(from); err != nil {
+		return result, err
+	}
+	if result.To, err = parse_time(to); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// parse_time reads hh:mm as the time since midnight, 24:00 is the end of the day
+func parse_time(value string) (time.Duration, error) {
+	if value == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, expect hh:mm", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/wushilin/go-vpn/common"
+	"github.com/wushilin/go-vpn/piper"
+	"github.com/wushilin/go-vpn/profile"
+	"github.com/wushilin/go-vpn/transport"
+)
+
+// How often the allowed hours of the connected clients are checked
+const PROFILE_CHECK_INTERVAL = time.Minute
+
+// lookup_profile returns the profile of the client, nil without -profiles or without a matching profile
+func lookup_profile(trans transport.Transport) *profile.Profile {
+	profiles := get_active_profiles()
+	if profiles == nil {
+		return nil
+	}
+	return profiles.Lookup(trans.PeerIdentities())
+}
+
+// admit tells whether the profile lets the client in at now, with the close reason when it doesn't
+func admit(client_profile *profile.Profile, now time.Time) (transport.CLOSE_REASON, bool) {
+	if client_profile == nil {
+		return transport.CLOSE, true
+	}
+	if !client_profile.Enabled {
+		return transport.DISABLED, false
+	}
+	if !client_profile.Open(now) {
+		return transport.OUTSIDE_HOURS, false
+	}
+	return transport.CLOSE, true
+}
+
+// apply_profile sets up the session of a client with its profile, nil is the same as no profile.
+// On a running session the changes are sent to the client over the control stream
+func apply_profile(pipe *piper.Pipe, client_profile *profile.Profile) {
+	pushed := common.ToArray(routes)
+	var policy piper.RoutePolicy
+	var bandwidth uint64
+	var name, address string
+	if client_profile != nil {
+		name = client_profile.Name
+		address = client_profile.Address
+		pushed = append(pushed, client_profile.Push...)
+		policy = client_profile
+		bandwidth = client_profile.Bandwidth
+	}
+	pipe.SetProfile(name, address)
+	pipe.SetRoutePolicy(policy)
+	pipe.SetBandwidth(bandwidth)
+	if config := push_config(client_profile); config.Encode() != pipe.Pushed().Encode() {
+		if err := pipe.SetPush(config); err != nil {
+			logger.Warn("Unable to push configuration", "session", pipe.Session, "error", err)
+		}
+	}
+	if !slices.Equal(pushed, pipe.RequestedRoutes()) {
+		if err := pipe.SetRoutes(pushed); err != nil {
+			logger.Warn("Unable to push routes", "session", pipe.Session, "error", err)
+		}
+	}
+}
+
+// push_config is the configuration pushed to a client, from the -push flags and its profile
+func push_config(client_profile *profile.Profile) piper.PushConfig {
+	result := piper.PushConfig{
+		DNS:          common.ToList(push_dns),
+		Search:       common.ToList(push_search),
+		DefaultRoute: push_default_route,
+	}
+	if client_profile == nil {
+		return result
+	}
+	if len(client_profile.DNS) > 0 {
+		result.DNS = client_profile.DNS
+	}
+	if len(client_profile.Search) > 0 {
+		result.Search = client_profile.Search
+	}
+	if client_profile.DefaultRoute != nil {
+		result.DefaultRoute = *client_profile.DefaultRoute
+	}
+	return result
+}
+
+// apply_profiles applies the current profiles to the connected clients. Clients no longer admitted, or
+// assigned another address, are disconnected
+func apply_profiles() {
+	now := time.Now()
+	for _, pipe := range get_active_pipes() {
+		if pipe.Started().IsZero() {
+			continue
+		}
+		client_profile := lookup_profile(pipe.Transport)
+		reason, ok := admit(client_profile, now)
+		if ok && client_profile != nil && client_profile.Address != pipe.PeerAddress() {
+			reason, ok = transport.PROFILE, false
+		}
+		if ok && client_profile == nil && pipe.PeerAddress() != "" {
+			reason, ok = transport.PROFILE, false
+		}
+		if !ok {
+			logger.Info("Disconnecting client", "session", pipe.Session, "peer", pipe.Transport.PeerName(), "reason", reason)
+			cancel_session(pipe.Session, transport.NewShutdown(reason))
+			continue
+		}
+		apply_profile(pipe, client_profile)
+	}
+}
+
+// enforce_profiles disconnects the clients at the end of their allowed hours
+func enforce_profiles(ctx context.Context) {
+	ticker := time.NewTicker(PROFILE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			apply_profiles()
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wushilin/go-vpn/logging"
+)
+
+// Dialer connects to address (host:port) on network tcp
+type Dialer func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// Time a client has to send its request, and the proxy to connect to the target
+const HANDSHAKE_TIMEOUT = 30 * time.Second
+
+const SOCKS_VERSION = 5
+const SOCKS_NO_AUTH = 0
+const SOCKS_NO_METHOD = 0xff
+const SOCKS_CONNECT = 1
+
+// Address types of a SOCKS request
+const SOCKS_IPV4 = 1
+const SOCKS_DOMAIN = 3
+const SOCKS_IPV6 = 4
+
+// Replies to a SOCKS request
+const SOCKS_SUCCEEDED = 0
+const SOCKS_FAILURE = 1
+const SOCKS_COMMAND_NOT_SUPPORTED = 7
+const SOCKS_ADDRESS_NOT_SUPPORTED = 8
+
+var logger = logging.For(logging.PROXY)
+
+// Serve accepts SOCKS5 and HTTP CONNECT clients on address until the listener is closed. The connections they ask
+// for are made with dial. Only CONNECT is supported, without authentication: bind to the loopback
+func Serve(address string, dial Dialer) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Proxy listening", "address", listener.Addr(), "protocols", "socks5,http-connect")
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn, dial)
+		}
+	}()
+	return listener, nil
+}
+
+// buffered_conn reads what the handshake left in the reader first
+type buffered_conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (v buffered_conn) Read(buffer []byte) (int, error) {
+	return v.reader.Read(buffer)
+}
+
+func (v buffered_conn) CloseWrite() error {
+	if closer, ok := v.Conn.(half_closer); ok {
+		return closer.CloseWrite()
+	}
+	return v.Conn.Close()
+}
+
+// handle tells SOCKS5 from HTTP by the first byte
+func handle(conn net.Conn, dial Dialer) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var target net.Conn
+	if first[0] == SOCKS_VERSION {
+		target, err = handle_socks(conn, reader, dial)
+	} else {
+		target, err = handle_http(conn, reader, dial)
+	}
+	if err != nil {
+		logger.Debug("Proxy request failed", "client", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	splice(buffered_conn{Conn: conn, reader: reader}, target)
+}
+
+// handle_socks answers a SOCKS5 CONNECT request, see RFC 1928
+func handle_socks(conn net.Conn, reader *bufio.Reader, dial Dialer) (net.Conn, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return nil, err
+	}
+	method := byte(SOCKS_NO_METHOD)
+	for _, next := range methods {
+		if next == SOCKS_NO_AUTH {
+			method = SOCKS_NO_AUTH
+		}
+	}
+	if _, err := conn.Write([]byte{SOCKS_VERSION, method}); err != nil {
+		return nil, err
+	}
+	if method == SOCKS_NO_METHOD {
+		return nil, errors.New("socks client requires authentication")
+	}
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return nil, err
+	}
+	if request[0] != SOCKS_VERSION {
+		return nil, fmt.Errorf("invalid socks version %d", request[0])
+	}
+	var host string
+	switch request[3] {
+	case SOCKS_IPV4, SOCKS_IPV6:
+		size := net.IPv4len
+		if request[3] == SOCKS_IPV6 {
+			size = net.IPv6len
+		}
+		address := make([]byte, size)
+		if _, err := io.ReadFull(reader, address); err != nil {
+			return nil, err
+		}
+		host = net.IP(address).String()
+	case SOCKS_DOMAIN:
+		size, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		domain := make([]byte, size)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		socks_reply(conn, SOCKS_ADDRESS_NOT_SUPPORTED)
+		return nil, fmt.Errorf("unsupported socks address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return nil, err
+	}
+	if request[1] != SOCKS_CONNECT {
+		socks_reply(conn, SOCKS_COMMAND_NOT_SUPPORTED)
+		return nil, fmt.Errorf("unsupported socks command %d", request[1])
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	target, err := connect(dial, address)
+	if err != nil {
+		socks_reply(conn, SOCKS_FAILURE)
+		return nil, err
+	}
+	if err := socks_reply(conn, SOCKS_SUCCEEDED); err != nil {
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+// socks_reply answers a request, without telling the bound address
+func socks_reply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{SOCKS_VERSION, reply, 0, SOCKS_IPV4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// handle_http answers an HTTP CONNECT request, other methods are refused
+func handle_http(conn net.Conn, reader *bufio.Reader, dial Dialer) (net.Conn, error) {
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+	if request.Method != http.MethodConnect {
+		http_reply(conn, http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("unsupported http method %s", request.Method)
+	}
+	address := request.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "443")
+	}
+	target, err := connect(dial, address)
+	if err != nil {
+		http_reply(conn, http.StatusBadGateway)
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+func http_reply(conn net.Conn, status int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
+
+func connect(dial Dialer, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HANDSHAKE_TIMEOUT)
+	defer cancel()
+	target, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", address, err)
+	}
+	logger.Debug("Proxying connection", "target", address)
+	return target, nil
+}
+
+// half_closer is a connection that can end its sending direction only
+type half_closer interface {
+	CloseWrite() error
+}
+
+// splice copies both ways until both sides are done, each end of file is passed on
+func splice(client net.Conn, target net.Conn) {
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	pass := func(to net.Conn, from io.Reader) {
+		defer wg.Done()
+		io.Copy(to, from)
+		if closer, ok := to.(half_closer); ok {
+			closer.CloseWrite()
+		} else {
+			to.Close()
+		}
+	}
+	go pass(target, client)
+	go pass(client, target)
+	wg.Wait()
+	client.Close()
+	target.Close()
+}
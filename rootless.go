@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/netstack"
+	"github.com/wushilin/go-vpn/piper"
+	"github.com/wushilin/go-vpn/proxy"
+	"github.com/wushilin/go-vpn/transport"
+)
+
+// start_rootless creates the userspace network stack the sessions of -rootless share, and the proxy into it.
+// The proxy stays up while reconnecting, its connections fail until the next session is up
+func start_rootless() *netstack.Stack {
+	stack_mtu := min(mtu, transport.MAX_PAYLOAD)
+	if stack_mtu <= 0 {
+		stack_mtu = piper.DEFAULT_MTU
+	}
+	stack, err := netstack.New(stack_mtu)
+	if err != nil {
+		logging.Fatal(logger, "Unable to create the userspace network stack", "error", err)
+	}
+	if _, err := proxy.Serve(proxy_address, stack.Dial); err != nil {
+		stack.Close()
+		logging.Fatal(logger, "Unable to serve the proxy", "address", proxy_address, "error", err)
+	}
+	logger.Info("Rootless mode, no TUN device", "proxy", proxy_address)
+	return stack
+}
+
+// reset_rootless gives the stack -laddr again, the previous server may have assigned another address
+func reset_rootless(stack *netstack.Stack, logger *slog.Logger) {
+	if laddr == "" {
+		return
+	}
+	if err := stack.SetAddress(laddr); err != nil {
+		logging.Fatal(logger, "Failed to set IP Address", "laddr", laddr, "error", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/wushilin/go-vpn/common"
+	"github.com/wushilin/go-vpn/logging"
+	"github.com/wushilin/go-vpn/piper"
+	"github.com/wushilin/go-vpn/stats"
+	"github.com/wushilin/go-vpn/transport"
+)
+
+// run_server accepts up to -max-clients sessions until stop_context is done. The sessions share the TUN
+// device through a hub, which routes between them. Fails when the listener or the TUN device fails first
+func run_server(stop_context context.Context, global_stats *stats.GlobalStats) error {
+	iface := create_device(logger)
+	defer delete_device(iface, laddr, logger)
+	hub, err := piper.NewHub(iface, global_stats)
+	if err != nil {
+		logging.Fatal(logger, "Unable to create hub", "error", err)
+	}
+	device := tun_device(iface, logger)
+	hub.ClientToClient = client_to_client == piper.CLIENT_TO_CLIENT_ALLOW
+	device_mtu := min(mtu, transport.MAX_PAYLOAD)
+	if device_mtu <= 0 {
+		device_mtu = piper.DEFAULT_MTU
+	}
+	if !common.SetMTU(device_name, device_mtu) {
+		logging.Fatal(logger, "Failed to set MTU", "device", device_name, "mtu", device_mtu)
+	}
+	// ends the sessions when the hub fails
+	server_context, stop_server := context.WithCancelCause(stop_context)
+	defer stop_server(nil)
+	hub_context, stop_hub := context.WithCancel(context.Background())
+	defer stop_hub()
+	go func() {
+		if err := hub.Run(hub_context); err != nil {
+			stop_server(err)
+		}
+	}()
+	hub.ListenForwards(hub_context, local_forwards)
+	if profiles_dir != "" {
+		go enforce_profiles(hub_context)
+	}
+
+	sessions := new(sync.WaitGroup)
+	defer sessions.Wait()
+	for server_context.Err() == nil {
+		if !wait_if_paused(server_context) {
+			continue
+		}
+		session := new_session_id()
+		session_context, cancel_session := new_session_context(server_context, session)
+		session_logger := logger.With("session", session)
+		trans, err := setup_server_transport(session_context, commonName, session)
+		if errors.Is(err, transport.ErrListenerClosed) {
+			cancel_session(nil)
+			stop_server(err)
+			break
+		}
+		if err != nil {
+			cancel_session(nil)
+			if session_context.Err() == nil {
+				session_logger.Warn("Setup Transport Error", "error", err)
+				count_handshake_failure(global_stats, err)
+			}
+			continue
+		}
+		client_profile := lookup_profile(trans)
+		if reason, ok := admit(client_profile, time.Now()); !ok {
+			cancel_session(nil)
+			session_logger.Warn("Rejecting client", "peer", trans.PeerName(), "profile", client_profile.Name, "reason", reason)
+			global_stats.IncreaseHandshakeFailure(transport.REASON_PROFILE)
+			trans.CloseWithReason(reason)
+			continue
+		}
+		pipe := new_pipe(device, trans, session, global_stats, session_logger)
+		pipe.Hub = hub
+		apply_profile(pipe, client_profile)
+		add_active_pipe(pipe)
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			defer cancel_session(nil)
+			defer remove_active_pipe(pipe)
+			run_pipe(session_context, pipe, global_stats, session_logger)
+		}()
+	}
+	if stop_context.Err() != nil {
+		logger.Info("Context stopped. Breaking")
+		return nil
+	}
+	return context.Cause(server_context)
+}
@@ -6,13 +6,21 @@ import (
 	"os/exec"
 	"strings"
 	"time"
+
+	"github.com/wushilin/go-vpn/backoff"
 )
 
 func main() {
+	retry := backoff.New()
+	// go-vpn reconnects by itself, a crash right after the start is what needs to slow down
+	retry.ResetAfter = time.Minute
 	for {
+		started := time.Now()
 		cmd("./go-vpn", os.Args[1:]...)
-		log.Println("./go-vpn crashed. Starting again in 3 seconds")
-		time.Sleep(3 * time.Second)
+		retry.Healthy(time.Since(started))
+		delay := retry.Next()
+		log.Printf("./go-vpn crashed. Starting again in %s (attempt %d)\n", delay.Round(time.Millisecond), retry.Attempts())
+		time.Sleep(delay)
 	}
 }
 
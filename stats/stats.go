@@ -1,13 +1,65 @@
 package stats
 
 import (
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type GlobalStats struct {
 	uploaded    uint64
 	downloaded  uint64
 	reconnected uint64
+	echo_sent   uint64
+	echo_lost   uint64
+	rtt         uint64
+	jitter      uint64
+	rules       sync.Map
+
+	uploaded_packets   uint64
+	downloaded_packets uint64
+	dropped            sync.Map
+	errors             sync.Map
+	routes             int64
+	peers              sync.Map
+	handshake_failures sync.Map
+	control_commands   sync.Map
+	backoff_attempts   uint64
+	backoff_delay      int64
+}
+
+// PeerStats counts the traffic exchanged with one peer, across reconnects
+type PeerStats struct {
+	uploaded           uint64
+	downloaded         uint64
+	uploaded_packets   uint64
+	downloaded_packets uint64
+}
+
+func (v *PeerStats) IncreaseUploaded(bytes uint64) {
+	atomic.AddUint64(&v.uploaded, bytes)
+	atomic.AddUint64(&v.uploaded_packets, 1)
+}
+
+func (v *PeerStats) IncreaseDownloaded(bytes uint64) {
+	atomic.AddUint64(&v.downloaded, bytes)
+	atomic.AddUint64(&v.downloaded_packets, 1)
+}
+
+func (v *PeerStats) UploadedBytes() uint64 {
+	return atomic.LoadUint64(&v.uploaded)
+}
+
+func (v *PeerStats) DownloadedBytes() uint64 {
+	return atomic.LoadUint64(&v.downloaded)
+}
+
+func (v *PeerStats) UploadedPackets() uint64 {
+	return atomic.LoadUint64(&v.uploaded_packets)
+}
+
+func (v *PeerStats) DownloadedPackets() uint64 {
+	return atomic.LoadUint64(&v.downloaded_packets)
 }
 
 func New() *GlobalStats {
@@ -15,6 +67,10 @@ func New() *GlobalStats {
 		uploaded:    0,
 		downloaded:  0,
 		reconnected: 0,
+		echo_sent:   0,
+		echo_lost:   0,
+		rtt:         0,
+		jitter:      0,
 	}
 }
 
@@ -30,6 +86,20 @@ func (v *GlobalStats) ReconnectedCount() uint64 {
 	return v.reconnected
 }
 
+// SetBackoff records the reconnect failures in a row and the current wait before the next attempt
+func (v *GlobalStats) SetBackoff(attempts int, delay time.Duration) {
+	atomic.StoreUint64(&v.backoff_attempts, uint64(attempts))
+	atomic.StoreInt64(&v.backoff_delay, int64(delay))
+}
+
+func (v *GlobalStats) BackoffAttempts() uint64 {
+	return atomic.LoadUint64(&v.backoff_attempts)
+}
+
+func (v *GlobalStats) BackoffDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&v.backoff_delay))
+}
+
 func (v *GlobalStats) IncreaseDownloadedBytes(new uint64) uint64 {
 	return atomic.AddUint64(&v.downloaded, new)
 }
@@ -41,3 +111,176 @@ func (v *GlobalStats) DownloadedBytes() uint64 {
 func (v *GlobalStats) UploadedBytes() uint64 {
 	return v.uploaded
 }
+
+func (v *GlobalStats) IncreaseEchoSent() uint64 {
+	return atomic.AddUint64(&v.echo_sent, 1)
+}
+
+func (v *GlobalStats) IncreaseEchoLost() uint64 {
+	return atomic.AddUint64(&v.echo_lost, 1)
+}
+
+func (v *GlobalStats) EchoSent() uint64 {
+	return atomic.LoadUint64(&v.echo_sent)
+}
+
+func (v *GlobalStats) EchoLost() uint64 {
+	return atomic.LoadUint64(&v.echo_lost)
+}
+
+// RecordRTT stores the latest round trip time and updates the jitter
+// estimate the same way RFC 3550 does (J += (|D| - J) / 16)
+func (v *GlobalStats) RecordRTT(rtt time.Duration) {
+	previous := atomic.SwapUint64(&v.rtt, uint64(rtt))
+	if previous == 0 {
+		return
+	}
+	delta := int64(rtt) - int64(previous)
+	if delta < 0 {
+		delta = -delta
+	}
+	jitter := int64(atomic.LoadUint64(&v.jitter))
+	jitter += (delta - jitter) / 16
+	atomic.StoreUint64(&v.jitter, uint64(jitter))
+}
+
+func (v *GlobalStats) RTT() time.Duration {
+	return time.Duration(atomic.LoadUint64(&v.rtt))
+}
+
+func (v *GlobalStats) Jitter() time.Duration {
+	return time.Duration(atomic.LoadUint64(&v.jitter))
+}
+
+// IncreaseRuleHit counts a packet matched by the named filter rule
+func (v *GlobalStats) IncreaseRuleHit(rule string) uint64 {
+	return increase_labeled(&v.rules, rule)
+}
+
+// RuleHits returns the number of packets matched by each filter rule
+func (v *GlobalStats) RuleHits() map[string]uint64 {
+	return snapshot_labeled(&v.rules)
+}
+
+// increase_labeled adds 1 to the counter of label in a map of counters
+func increase_labeled(m *sync.Map, label string) uint64 {
+	counter, ok := m.Load(label)
+	if !ok {
+		counter, _ = m.LoadOrStore(label, new(uint64))
+	}
+	return atomic.AddUint64(counter.(*uint64), 1)
+}
+
+func snapshot_labeled(m *sync.Map) map[string]uint64 {
+	result := make(map[string]uint64)
+	m.Range(func(key, value any) bool {
+		result[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+	return result
+}
+
+func (v *GlobalStats) IncreaseUploadedPackets() uint64 {
+	return atomic.AddUint64(&v.uploaded_packets, 1)
+}
+
+func (v *GlobalStats) IncreaseDownloadedPackets() uint64 {
+	return atomic.AddUint64(&v.downloaded_packets, 1)
+}
+
+func (v *GlobalStats) UploadedPackets() uint64 {
+	return atomic.LoadUint64(&v.uploaded_packets)
+}
+
+func (v *GlobalStats) DownloadedPackets() uint64 {
+	return atomic.LoadUint64(&v.downloaded_packets)
+}
+
+// Reasons a packet is dropped
+const DROP_OVERSIZE = "oversize"
+const DROP_FILTER = "filter"
+const DROP_NO_ROUTE = "no_route"
+const DROP_TRANSPORT_CLOSED = "transport_closed"
+const DROP_CLIENT_TO_CLIENT = "client_to_client"
+const DROP_BANDWIDTH = "bandwidth"
+const DROP_QUEUE_FULL = "queue_full" // a session of the hub doesn't keep up
+
+// Kinds of I/O errors
+const ERROR_TUN_READ = "tun_read"
+const ERROR_TUN_WRITE = "tun_write"
+const ERROR_TRANSPORT_READ = "transport_read"
+const ERROR_TRANSPORT_WRITE = "transport_write"
+
+// IncreaseDropped counts a packet dropped for the reason. Safe on a nil GlobalStats
+func (v *GlobalStats) IncreaseDropped(reason string) uint64 {
+	if v == nil {
+		return 0
+	}
+	return increase_labeled(&v.dropped, reason)
+}
+
+// Dropped is the number of packets dropped for any reason
+func (v *GlobalStats) Dropped() uint64 {
+	var result uint64
+	for _, count := range v.DroppedByReason() {
+		result += count
+	}
+	return result
+}
+
+func (v *GlobalStats) DroppedByReason() map[string]uint64 {
+	return snapshot_labeled(&v.dropped)
+}
+
+func (v *GlobalStats) IncreaseError(kind string) uint64 {
+	return increase_labeled(&v.errors, kind)
+}
+
+func (v *GlobalStats) Errors() map[string]uint64 {
+	return snapshot_labeled(&v.errors)
+}
+
+// SetRoutes records the number of routes installed for the peer
+func (v *GlobalStats) SetRoutes(count int) {
+	atomic.StoreInt64(&v.routes, int64(count))
+}
+
+func (v *GlobalStats) Routes() int {
+	return int(atomic.LoadInt64(&v.routes))
+}
+
+// Peer returns the counters of the peer with the given identity
+func (v *GlobalStats) Peer(name string) *PeerStats {
+	result, ok := v.peers.Load(name)
+	if !ok {
+		result, _ = v.peers.LoadOrStore(name, new(PeerStats))
+	}
+	return result.(*PeerStats)
+}
+
+func (v *GlobalStats) Peers() map[string]*PeerStats {
+	result := make(map[string]*PeerStats)
+	v.peers.Range(func(key, value any) bool {
+		result[key.(string)] = value.(*PeerStats)
+		return true
+	})
+	return result
+}
+
+// IncreaseHandshakeFailure counts a failed connection setup by reason
+func (v *GlobalStats) IncreaseHandshakeFailure(reason string) uint64 {
+	return increase_labeled(&v.handshake_failures, reason)
+}
+
+func (v *GlobalStats) HandshakeFailures() map[string]uint64 {
+	return snapshot_labeled(&v.handshake_failures)
+}
+
+// IncreaseControlCommand counts a control command sent or received, labeled `<direction>:<command>`
+func (v *GlobalStats) IncreaseControlCommand(direction string, command string) uint64 {
+	return increase_labeled(&v.control_commands, direction+":"+command)
+}
+
+func (v *GlobalStats) ControlCommands() map[string]uint64 {
+	return snapshot_labeled(&v.control_commands)
+}
@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Order in which the endpoints are tried
+const ORDER_PRIORITY = "priority"
+const ORDER_RANDOM = "random"
+
+// Endpoint is one address of a server
+type Endpoint struct {
+	// host:port as configured, the host is verified against the server certificate
+	Server string
+	// Resolved ip:port
+	Address string
+	// Position of the server in the configured list, lower is preferred
+	Priority int
+}
+
+func (v Endpoint) String() string {
+	if v.Server == v.Address {
+		return v.Address
+	}
+	return fmt.Sprintf("%s (%s)", v.Server, v.Address)
+}
+
+// Endpoints are the servers a client may connect to. Every server may be a DNS name resolving to several addresses.
+// Endpoints that failed are tried after the others, the oldest failure first
+type Endpoints struct {
+	Servers []string
+	Order   string
+
+	mutex  sync.Mutex
+	failed map[string]time.Time
+}
+
+// ParseEndpoints reads the comma separated host:port list given to -s
+func ParseEndpoints(value string, order string) (*Endpoints, error) {
+	if order != ORDER_PRIORITY && order != ORDER_RANDOM {
+		return nil, fmt.Errorf("invalid order %s, expect %s or %s", order, ORDER_PRIORITY, ORDER_RANDOM)
+	}
+	result := &Endpoints{Order: order, failed: make(map[string]time.Time)}
+	for _, next := range strings.Split(value, ",") {
+		next = strings.TrimSpace(next)
+		if next == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(next); err != nil {
+			return nil, fmt.Errorf("invalid server %s: %w", next, err)
+		}
+		result.Servers = append(result.Servers, next)
+	}
+	if len(result.Servers) == 0 {
+		return nil, errors.New("no server given")
+	}
+	return result, nil
+}
+
+// Candidates resolves the servers and returns the endpoints in the order they should be tried
+func (v *Endpoints) Candidates(ctx context.Context) ([]Endpoint, error) {
+	servers := slices.Clone(v.Servers)
+	if v.Order == ORDER_RANDOM {
+		rand.Shuffle(len(servers), func(i, j int) {
+			servers[i], servers[j] = servers[j], servers[i]
+		})
+	}
+	var result []Endpoint
+	var errs []error
+	for _, server := range servers {
+		host, port, _ := net.SplitHostPort(server)
+		addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if v.Order == ORDER_RANDOM {
+			rand.Shuffle(len(addresses), func(i, j int) {
+				addresses[i], addresses[j] = addresses[j], addresses[i]
+			})
+		}
+		for _, address := range addresses {
+			result = append(result, Endpoint{
+				Server:   server,
+				Address:  net.JoinHostPort(address, port),
+				Priority: slices.Index(v.Servers, server),
+			})
+		}
+	}
+	if len(result) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	slices.SortStableFunc(result, func(a, b Endpoint) int {
+		return v.failed[a.Address].Compare(v.failed[b.Address])
+	})
+	return result, nil
+}
+
+// Failed moves the endpoint after the others, until it succeeds again
+func (v *Endpoints) Failed(endpoint Endpoint) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.failed[endpoint.Address] = time.Now()
+}
+
+func (v *Endpoints) Succeeded(endpoint Endpoint) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.failed, endpoint.Address)
+}
+
+// Preferred returns the endpoints of the servers configured before the one of endpoint, the failback targets.
+// Empty when the order is random
+func (v *Endpoints) Preferred(ctx context.Context, endpoint Endpoint) []Endpoint {
+	if v.Order != ORDER_PRIORITY || endpoint.Priority == 0 {
+		return nil
+	}
+	candidates, _ := v.Candidates(ctx)
+	var result []Endpoint
+	for _, next := range candidates {
+		if next.Priority < endpoint.Priority {
+			result = append(result, next)
+		}
+	}
+	slices.SortStableFunc(result, func(a, b Endpoint) int {
+		return a.Priority - b.Priority
+	})
+	return result
+}
+
+// Probe checks the server at endpoint completes a QUIC handshake, without starting a session
+func (v QuicConfig) Probe(ctx context.Context, endpoint Endpoint) error {
+	tls_config := v.GenerateTLSConfig(endpoint.Server, false)
+	conn, err := v.dial(ctx, endpoint.Address, tls_config)
+	if err != nil {
+		return err
+	}
+	return CloseConn(conn, PROBE)
+}
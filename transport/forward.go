@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// First byte of every stream after the control stream, written by Ping for the data streams
+const STREAM_DATA byte = 0
+const STREAM_FORWARD byte = 1
+
+// Forwarded connections open at the same time, on top of the data streams
+const FORWARD_STREAMS = 1000
+
+// Forward streams waiting for AcceptForward, more are refused
+const FORWARD_BACKLOG = 16
+
+// How long the peer has to tell the type of a new stream
+const STREAM_TYPE_TIMEOUT = 10 * time.Second
+
+var ErrClosed = errors.New("connection closed")
+
+// Stream carries one forwarded connection. CloseWrite ends the sending direction, Close ends both
+type Stream interface {
+	io.ReadWriteCloser
+	CloseWrite() error
+}
+
+type forward_stream struct {
+	stream *quic.Stream
+}
+
+func (v forward_stream) Read(buffer []byte) (int, error) {
+	return v.stream.Read(buffer)
+}
+
+func (v forward_stream) Write(buffer []byte) (int, error) {
+	return v.stream.Write(buffer)
+}
+
+func (v forward_stream) CloseWrite() error {
+	return v.stream.Close()
+}
+
+func (v forward_stream) Close() error {
+	v.stream.CancelRead(0)
+	return v.stream.Close()
+}
+
+// accept_streams accepts the streams the peer opens after the control stream, for the life of conn.
+// Data streams go to data, nil when this side opens them, forward streams to forwards. Both are closed at the end
+func accept_streams(conn *quic.Conn, data chan<- *quic.Stream, forwards chan<- *quic.Stream, logger *slog.Logger) {
+	defer func() {
+		if data != nil {
+			close(data)
+		}
+		close(forwards)
+	}()
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		kind := make([]byte, 1)
+		stream.SetReadDeadline(time.Now().Add(STREAM_TYPE_TIMEOUT))
+		_, err = io.ReadFull(stream, kind)
+		stream.SetReadDeadline(time.Time{})
+		if err != nil {
+			logger.Debug("Stream closed before its type", "error", err)
+			stream.CancelRead(0)
+			stream.Close()
+			continue
+		}
+		target := forwards
+		if kind[0] == STREAM_DATA {
+			target = data
+		} else if kind[0] != STREAM_FORWARD {
+			target = nil
+		}
+		select {
+		case target <- stream:
+		default:
+			// nil target, or nobody keeping up
+			logger.Warn("Refusing stream", "type", kind[0])
+			stream.CancelRead(0)
+			stream.Close()
+		}
+	}
+}
+
+// open_forward opens a stream for a forwarded connection
+func open_forward(ctx context.Context, conn *quic.Conn) (Stream, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write([]byte{STREAM_FORWARD}); err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, err
+	}
+	return forward_stream{stream}, nil
+}
+
+// accept_forward waits for the next forward stream of the peer
+func accept_forward(ctx context.Context, forwards <-chan *quic.Stream) (Stream, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case stream, ok := <-forwards:
+		if !ok {
+			return nil, ErrClosed
+		}
+		return forward_stream{stream}, nil
+	}
+}
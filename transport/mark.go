@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"syscall"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// listen_udp opens the UDP socket of a QUIC transport. A mark other than 0 is set as SO_MARK on it,
+// so ip rules can keep the packets of the tunnel out of the tunnel
+func listen_udp(address string, mark int) (net.PacketConn, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var result error
+			err := conn.Control(func(fd uintptr) {
+				result = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			})
+			if err != nil {
+				return err
+			}
+			return result
+		},
+	}
+	return config.ListenPacket(context.Background(), "udp", address)
+}
+
+// dial connects to address, from a socket marked with Mark when set
+func (v QuicConfig) dial(ctx context.Context, address string, tls_config *tls.Config) (*quic.Conn, error) {
+	if v.Mark == 0 {
+		return quic.DialAddr(ctx, address, tls_config, DefaultConfig())
+	}
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := listen_udp(":0", v.Mark)
+	if err != nil {
+		return nil, err
+	}
+	transport := &quic.Transport{Conn: socket}
+	conn, err := transport.Dial(ctx, remote, tls_config, DefaultConfig())
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	// the socket belongs to this connection only
+	go func() {
+		<-conn.Context().Done()
+		transport.Close()
+	}()
+	return conn, nil
+}
+
+// listen accepts connections on bind_string, on a socket marked with Mark when set
+func (v QuicConfig) listen(bind_string string, tls_config *tls.Config) (*quic.Listener, error) {
+	if v.Mark == 0 {
+		return quic.ListenAddr(bind_string, tls_config, DefaultConfig())
+	}
+	socket, err := listen_udp(bind_string, v.Mark)
+	if err != nil {
+		return nil, err
+	}
+	transport := &quic.Transport{Conn: socket}
+	return transport.Listen(tls_config, DefaultConfig())
+}
@@ -2,11 +2,9 @@ package transport
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"log"
-	"math/rand"
-	"time"
+	"log/slog"
+	"sync"
 
 	quic "github.com/quic-go/quic-go"
 	"github.com/wushilin/go-vpn/message"
@@ -19,6 +17,14 @@ type QuicClientTransport struct {
 	ControlStream *quic.Stream
 	BufferChannel chan Buffer
 	BufferPool    *pool.Pool[[]byte]
+	Log           *slog.Logger
+
+	// one per stream, held while a packet is written
+	write_locks []sync.Mutex
+	// closed by RunReaders once all Streams are set
+	streams_ready chan struct{}
+	// forward streams opened by the server
+	forwards chan *quic.Stream
 }
 
 // Read may read from a random channel by order of insertion
@@ -26,6 +32,26 @@ func (v *QuicClientTransport) Read(buffer []byte) (int, error) {
 	return qRead(v.BufferPool, v.BufferChannel, buffer)
 }
 
+func (v *QuicClientTransport) GetPoolStats() PoolStats {
+	return get_pool_stats(v.BufferPool)
+}
+
+func (v *QuicClientTransport) RemoteAddr() string {
+	return v.Conn.RemoteAddr().String()
+}
+
+func (v *QuicClientTransport) PeerName() string {
+	return peer_name(v.Conn)
+}
+
+func (v *QuicClientTransport) PeerIdentities() []string {
+	return peer_identities(v.Conn)
+}
+
+func (v *QuicClientTransport) MaxPayload() int {
+	return MAX_PAYLOAD
+}
+
 func (v *QuicClientTransport) GetStats() string {
 	return get_stats(v.BufferPool)
 }
@@ -38,40 +64,39 @@ func (v *QuicClientTransport) WriteControlCommand(command message.Command) (int,
 	return WriteCommand(v.ControlStream, command)
 }
 
-// Write write to a random channel
+// Write write to the stream of the packet's flow
 func (v *QuicClientTransport) Write(buffer []byte) (int, error) {
-	size := len(buffer)
-	if size > 0xFFFF {
-		return 0, errors.New("buffer too long. Expect less than 0xffff bytes")
-	}
-
-	for {
-		var selected int = rand.Intn(len(v.Streams))
-		var stream = v.Streams[selected]
-		if stream == nil {
-			time.Sleep(100 * time.Millisecond)
-			continue
-		}
-		stream.Write([]byte{byte(size / 256), byte(size % 256)})
-		return stream.Write(buffer)
-	}
+	return qWrite(v.Conn, v.Streams, v.write_locks, v.streams_ready, buffer)
 }
 
 func (v *QuicClientTransport) Close() error {
+	return v.CloseWithReason(CLOSE)
+}
+
+func (v *QuicClientTransport) CloseWithReason(reason CLOSE_REASON) error {
 	v.ControlStream.Close()
-	return CloseConn(v.Conn, CLOSE)
+	return CloseConn(v.Conn, reason)
 }
 func (v *QuicClientTransport) RunReaders() error {
-	return runReaders(v.BufferPool, v.Conn, v.Streams, v.BufferChannel, false)
+	return runReaders(v.BufferPool, v.Conn, v.Streams, v.streams_ready, v.BufferChannel, nil, v.Log)
 }
 
-func NewQuicClientTransport(config QuicConfig, server_addr string, ctx context.Context, certName string) (result Transport, cause error) {
+func (v *QuicClientTransport) OpenForward(ctx context.Context) (Stream, error) {
+	return open_forward(ctx, v.Conn)
+}
+
+func (v *QuicClientTransport) AcceptForward(ctx context.Context) (Stream, error) {
+	return accept_forward(ctx, v.forwards)
+}
+
+func NewQuicClientTransport(config QuicConfig, endpoint Endpoint, ctx context.Context, certName string) (result Transport, cause error) {
 	var conn *quic.Conn
 	var control_stream *quic.Stream
 	var err error
+	logger := config.logger()
 	var cleanup = func() {
 		if result == nil {
-			log.Printf("Cleaning up client connections %s\n", cause)
+			logger.Warn("Cleaning up client connections", "error", cause)
 			if control_stream != nil {
 				control_stream.Close()
 			}
@@ -82,35 +107,47 @@ func NewQuicClientTransport(config QuicConfig, server_addr string, ctx context.C
 	}
 
 	defer cleanup()
-	conn, err = quic.DialAddr(ctx, server_addr, config.GenerateTLSConfig(server_addr, false), DefaultConfig())
+	conn, err = config.dial(ctx, endpoint.Address, config.GenerateTLSConfig(endpoint.Server, false))
 	if err != nil {
-		return nil, err
+		return nil, NewHandshakeError(REASON_CONNECT, err)
 	}
+	logger.Info("Connected", "endpoint", endpoint, "peer", peer_name(conn))
 	if certName != "" {
 		actual_cert_name := conn.ConnectionState().TLS.PeerCertificates[0].Subject.CommonName
 		if certName != actual_cert_name {
-			log.Printf("%v\n", conn.ConnectionState().TLS.PeerCertificates[0].Subject.CommonName)
-			return nil, fmt.Errorf("invalid cert name %s != expected: %s", actual_cert_name, certName)
+			return nil, NewHandshakeError(REASON_CERTIFICATE, fmt.Errorf("invalid cert name %s != expected: %s", actual_cert_name, certName))
 		}
 	}
 	control_stream, err = conn.OpenStreamSync(context.Background())
 	if err != nil {
-		return nil, err
+		return nil, NewHandshakeError(REASON_CONTROL, err)
 	}
 	if err := Ping(control_stream); err != nil {
-		return nil, err
+		return nil, NewHandshakeError(REASON_CONTROL, err)
+	}
+	streams := config.Streams
+	if streams <= 0 {
+		streams = STREAMS
+	}
+	if err := WriteStreamCount(control_stream, streams); err != nil {
+		return nil, NewHandshakeError(REASON_STREAMS, err)
 	}
 	resultp := &QuicClientTransport{
 		Conn:          conn,
 		ControlStream: control_stream,
-		Streams:       make([]*quic.Stream, STREAMS),
+		Streams:       make([]*quic.Stream, streams),
+		write_locks:   make([]sync.Mutex, streams),
+		streams_ready: make(chan struct{}),
 		BufferChannel: make(chan Buffer, 1000),
+		forwards:      make(chan *quic.Stream, FORWARD_BACKLOG),
+		Log:           logger,
 		BufferPool: pool.NewFixedPool(300, func() ([]byte, error) {
-			return make([]byte, 4096), nil
+			return make([]byte, BUFFER_SIZE), nil
 		}).WithIdleTimeout(99999999).WithTester(func(b []byte) bool {
 			return true
 		}),
 	}
+	go accept_streams(conn, nil, resultp.forwards, logger)
 	go resultp.RunReaders()
 	result = resultp
 	cause = nil
@@ -4,8 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
-	"math/rand"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	quic "github.com/quic-go/quic-go"
@@ -14,17 +15,36 @@ import (
 )
 
 type QuicServerTransport struct {
-	Listener      *quic.Listener
 	Conn          *quic.Conn
 	Streams       []*quic.Stream
 	ControlStream *quic.Stream
 	BufferChannel chan Buffer
 	BufferPool    *pool.Pool[[]byte]
+	Log           *slog.Logger
+
+	// one per stream, held while a packet is written
+	write_locks []sync.Mutex
+	// closed by RunReaders once all Streams are set
+	streams_ready chan struct{}
+
+	// tells the listener the session is over
+	release func()
+	// data and forward streams opened by the client
+	data     chan *quic.Stream
+	forwards chan *quic.Stream
 }
 
 // Sync functino to perform all reading. When it returns, all streams are closed
 func (v *QuicServerTransport) RunReaders() error {
-	return runReaders(v.BufferPool, v.Conn, v.Streams, v.BufferChannel, true)
+	return runReaders(v.BufferPool, v.Conn, v.Streams, v.streams_ready, v.BufferChannel, v.data, v.Log)
+}
+
+func (v *QuicServerTransport) OpenForward(ctx context.Context) (Stream, error) {
+	return open_forward(ctx, v.Conn)
+}
+
+func (v *QuicServerTransport) AcceptForward(ctx context.Context) (Stream, error) {
+	return accept_forward(ctx, v.forwards)
 }
 
 // Read may read from a random channel by order of insertion
@@ -39,98 +59,246 @@ func (v *QuicServerTransport) ReadControlCommand() (message.Command, error) {
 func (v *QuicServerTransport) WriteControlCommand(command message.Command) (int, error) {
 	return WriteCommand(v.ControlStream, command)
 }
+func (v *QuicServerTransport) GetPoolStats() PoolStats {
+	return get_pool_stats(v.BufferPool)
+}
+
+func (v *QuicServerTransport) RemoteAddr() string {
+	return v.Conn.RemoteAddr().String()
+}
+
+func (v *QuicServerTransport) PeerName() string {
+	return peer_name(v.Conn)
+}
+
+func (v *QuicServerTransport) PeerIdentities() []string {
+	return peer_identities(v.Conn)
+}
+
+func (v *QuicServerTransport) MaxPayload() int {
+	return MAX_PAYLOAD
+}
+
 func (v *QuicServerTransport) GetStats() string {
 	return get_stats(v.BufferPool)
 }
 
-// Write write to a random channel
+// Write write to the stream of the packet's flow
 func (v *QuicServerTransport) Write(buffer []byte) (int, error) {
-	size := len(buffer)
-	if size > 0xFFFF {
-		return 0, errors.New("buffer too long. Expect less than 0xffff bytes")
+	return qWrite(v.Conn, v.Streams, v.write_locks, v.streams_ready, buffer)
+}
+
+func (v *QuicServerTransport) Close() error {
+	return v.CloseWithReason(CLOSE)
+}
+
+func (v *QuicServerTransport) CloseWithReason(reason CLOSE_REASON) error {
+	v.release()
+	v.ControlStream.Close()
+	return CloseConn(v.Conn, reason)
+}
+
+// QuicListener owns the UDP port of the server for the life of the process. Connections are accepted and
+// set up in the background, each on its own, and handed to Accept. Clients arriving while MaxClients sessions
+// are running, or while MaxClients others are being set up, are rejected
+type QuicListener struct {
+	Listener *quic.Listener
+	Log      *slog.Logger
+	// Sessions running at the same time
+	MaxClients int
+
+	// ends the handshakes in progress when the listener is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// handshakes in progress or waiting for Accept, at most MaxClients
+	pending    atomic.Int32
+	handshakes sync.WaitGroup
+	ready      chan handshake_result
+	clients    atomic.Int32
+}
+
+// handshake_result is a connection set up in the background, or why it couldn't be
+type handshake_result struct {
+	conn      *quic.Conn
+	transport *QuicServerTransport
+	err       error
+}
+
+// Time a client has to open its control stream and tell its stream count once connected, and each side to set up
+// its data streams
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+func NewQuicListener(config QuicConfig, bind_string string, max_clients int) (*QuicListener, error) {
+	listener, err := config.listen(bind_string, config.GenerateTLSConfig("", true))
+	if err != nil {
+		return nil, err
+	}
+	result := &QuicListener{
+		Listener:   listener,
+		Log:        config.logger(),
+		MaxClients: max(max_clients, 1),
 	}
+	result.ready = make(chan handshake_result, result.MaxClients)
+	result.ctx, result.cancel = context.WithCancel(context.Background())
+	result.Log.Info("Server listening", "bind", bind_string, "max_clients", result.MaxClients)
+	go result.run()
+	return result, nil
+}
 
+// Clients is the number of sessions running
+func (v *QuicListener) Clients() int {
+	return int(v.clients.Load())
+}
+
+func (v *QuicListener) full() bool {
+	return v.Clients() >= v.MaxClients
+}
+
+func (v *QuicListener) run() {
+	defer func() {
+		v.handshakes.Wait()
+		close(v.ready)
+	}()
 	for {
-		var selected int = rand.Intn(len(v.Streams))
-		var stream = v.Streams[selected]
-		if stream == nil {
-			time.Sleep(100 * time.Millisecond)
+		conn, err := v.Listener.Accept(context.Background())
+		if err != nil {
+			v.Log.Debug("Listener closed", "error", err)
+			return
+		}
+		if v.full() {
+			v.Log.Warn("Rejecting client, the server is full", "remote", conn.RemoteAddr(), "peer", peer_name(conn), "clients", v.Clients())
+			CloseConn(conn, BUSY)
 			continue
 		}
-		stream.Write([]byte{byte(size / 256)})
-		stream.Write([]byte{byte(size % 256)})
-		return stream.Write(buffer)
+		if int(v.pending.Add(1)) > v.MaxClients {
+			v.pending.Add(-1)
+			v.Log.Warn("Rejecting client, too many are connecting", "remote", conn.RemoteAddr(), "peer", peer_name(conn), "connecting", v.MaxClients)
+			CloseConn(conn, BUSY)
+			continue
+		}
+		v.handshakes.Add(1)
+		go func() {
+			defer v.handshakes.Done()
+			ctx, cancel := context.WithTimeout(v.ctx, HANDSHAKE_TIMEOUT)
+			defer cancel()
+			result, err := v.handshake(ctx, conn)
+			// never blocks, there is room for every pending connection
+			v.ready <- handshake_result{conn: conn, transport: result, err: err}
+		}()
 	}
 }
 
-func (v *QuicServerTransport) Close() error {
-	if v.Listener != nil {
-		v.Listener.Close()
-	}
-	v.ControlStream.Close()
-	return CloseConn(v.Conn, CLOSE)
-}
-
-func NewQuicServerTransport(config QuicConfig, bind_string string, ctx context.Context, certName string) (result Transport, cause error) {
-	var listener *quic.Listener = nil
-	var conn *quic.Conn = nil
-	var control_stream *quic.Stream = nil
-	var err error
-	cleanup := func() {
-		if result == nil {
-			log.Printf("Setup ServerTransport failed: %s\n", cause)
-			if control_stream != nil {
-				control_stream.Close()
-			}
-			if conn != nil {
-				CloseConn(conn, CLOSE)
+// Returned by Accept once the listener is closed or failed, no client can connect anymore
+var ErrListenerClosed = errors.New("listener closed")
+
+// a client got past run while the last session was set up
+var errFull = errors.New("server full")
+
+func (v *QuicListener) Close() error {
+	v.cancel()
+	return v.Listener.Close()
+}
+
+// Accept waits for a client set up in the background and starts its session. Probes of clients checking the
+// server is up are skipped
+func (v *QuicListener) Accept(config QuicConfig, ctx context.Context, certName string) (Transport, error) {
+	logger := config.logger()
+	for {
+		var next handshake_result
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case result, ok := <-v.ready:
+			if !ok {
+				return nil, ErrListenerClosed
 			}
-			if listener != nil {
-				listener.Close()
+			v.pending.Add(-1)
+			next = result
+		}
+		conn, err := next.conn, next.err
+		if errors.Is(err, ErrProbe) {
+			logger.Debug("Probed by client", "remote", conn.RemoteAddr(), "peer", peer_name(conn))
+			continue
+		}
+		if errors.Is(err, errFull) {
+			logger.Warn("Rejecting client, the server is full", "remote", conn.RemoteAddr(), "peer", peer_name(conn), "clients", v.Clients())
+			CloseConn(conn, BUSY)
+			continue
+		}
+		if err == nil && certName != "" {
+			actual_cert_name := conn.ConnectionState().TLS.PeerCertificates[0].Subject.CommonName
+			if certName != actual_cert_name {
+				next.transport.release()
+				err = NewHandshakeError(REASON_CERTIFICATE, fmt.Errorf("invalid cert name %s != expected: %s", actual_cert_name, certName))
 			}
-			log.Printf("Cleaning up of ServerTransport done\n")
 		}
+		if err != nil {
+			logger.Warn("Setup ServerTransport failed", "remote", conn.RemoteAddr(), "error", err)
+			CloseConn(conn, CLOSE)
+			return nil, err
+		}
+		result := next.transport
+		result.Log = logger
+		go accept_streams(conn, result.data, result.forwards, logger)
+		go result.RunReaders()
+		return result, nil
 	}
-	defer cleanup()
-	listener, err = quic.ListenAddr(bind_string, config.GenerateTLSConfig("", true), DefaultConfig())
-	log.Println("Server listening on ", bind_string)
+}
+
+// handshake accepts the control stream and the stream count of the client, until ctx is done
+func (v *QuicListener) handshake(ctx context.Context, conn *quic.Conn) (*QuicServerTransport, error) {
+	logger := v.Log
+	logger.Info("Accepted connection", "remote", conn.RemoteAddr(), "peer", peer_name(conn))
+	control_stream, err := conn.AcceptStream(ctx)
 	if err != nil {
-		return nil, err
+		if is_close_reason(err, PROBE) {
+			return nil, ErrProbe
+		}
+		return nil, NewHandshakeError(REASON_CONTROL, err)
 	}
-	conn, err = listener.Accept(ctx)
-	if err != nil {
-		return nil, err
+	// from here on, the session counts against MaxClients
+	if int(v.clients.Add(1)) > v.MaxClients {
+		v.clients.Add(-1)
+		control_stream.CancelRead(0)
+		control_stream.Close()
+		return nil, errFull
 	}
-	if certName != "" {
-		actual_cert_name := conn.ConnectionState().TLS.PeerCertificates[0].Subject.CommonName
-		if certName != actual_cert_name {
-			log.Printf("%v\n", conn.ConnectionState().TLS.PeerCertificates[0].Subject.CommonName)
-			return nil, fmt.Errorf("invalid cert name %s != expected: %s", actual_cert_name, certName)
-		}
+	release := sync.OnceFunc(func() {
+		v.clients.Add(-1)
+	})
+	fail := func(reason string, err error) (*QuicServerTransport, error) {
+		control_stream.Close()
+		release()
+		return nil, NewHandshakeError(reason, err)
 	}
-
-	control_stream, err = conn.AcceptStream(context.Background())
-	if err != nil {
-		return nil, err
+	if deadline, ok := ctx.Deadline(); ok {
+		control_stream.SetReadDeadline(deadline)
 	}
 	if err := Pong(control_stream); err != nil {
-		return nil, err
+		return fail(REASON_CONTROL, err)
+	}
+	streams, err := ReadStreamCount(control_stream)
+	if err != nil {
+		return fail(REASON_STREAMS, err)
 	}
+	control_stream.SetReadDeadline(time.Time{})
 
 	resultp := &QuicServerTransport{
-		Listener:      listener,
 		Conn:          conn,
 		ControlStream: control_stream,
-		Streams:       make([]*quic.Stream, STREAMS),
+		Streams:       make([]*quic.Stream, streams),
+		write_locks:   make([]sync.Mutex, streams),
+		streams_ready: make(chan struct{}),
 		BufferChannel: make(chan Buffer, 1000),
+		Log:           logger,
+		release:       release,
+		data:          make(chan *quic.Stream, streams),
+		forwards:      make(chan *quic.Stream, FORWARD_BACKLOG),
 		BufferPool: pool.NewFixedPool(300, func() ([]byte, error) {
-			return make([]byte, 4096), nil
+			return make([]byte, BUFFER_SIZE), nil
 		}).WithIdleTimeout(99999999).WithTester(func(b []byte) bool {
 			return true
 		}),
 	}
-	go resultp.RunReaders()
-	result = resultp
-	cause = nil
-	return result, cause
+	return resultp, nil
 }
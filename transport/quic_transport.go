@@ -5,62 +5,172 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
 	quic "github.com/quic-go/quic-go"
+	"github.com/wushilin/go-vpn/logging"
 	"github.com/wushilin/go-vpn/message"
+	"github.com/wushilin/go-vpn/packet"
 	"github.com/wushilin/pool"
 )
 
+// Default number of data streams a client opens
 const STREAMS = 30
 
+// Upper bound of data streams a client may ask for
+const MAX_STREAMS = 256
+
+// Size of the pooled buffers holding a framed packet (2 bytes length + packet)
+const BUFFER_SIZE = 4096
+
+// Largest IP packet the transport can carry in one frame. A limit of the buffers, not of the path: the frames
+// travel in QUIC streams, split over QUIC packets as needed
+const MAX_PAYLOAD = BUFFER_SIZE - 2
+
 type QuicConfig struct {
 	KeyFile  string
 	CertFile string
 	CAFile   string
+	// Number of data streams. Only used by the client, the server follows the client. 0 means STREAMS
+	Streams int
+	// Identifies the session in the logs
+	Session string
+	// SO_MARK of the UDP socket, 0 leaves it unmarked
+	Mark int
+}
+
+func (v QuicConfig) logger() *slog.Logger {
+	return logging.For(logging.TRANSPORT).With("session", v.Session)
 }
 
 type CLOSE_REASON int
 
 const CLOSE CLOSE_REASON = 0
 const CONTROL CLOSE_REASON = 1
+const PROBE CLOSE_REASON = 2
+const BUSY CLOSE_REASON = 3
+const SHUTDOWN CLOSE_REASON = 4
+const DISCONNECT CLOSE_REASON = 5
+const RECONNECT CLOSE_REASON = 6
+const FAILBACK CLOSE_REASON = 7
+const DISABLED CLOSE_REASON = 8
+const OUTSIDE_HOURS CLOSE_REASON = 9
+const PROFILE CLOSE_REASON = 10
 
 var REASON_STRING = map[CLOSE_REASON]string{
-	CLOSE:   "graceful shutdown",
-	CONTROL: "control stream can't be openned",
+	CLOSE:         "graceful shutdown",
+	CONTROL:       "control stream can't be openned",
+	PROBE:         "probe",
+	BUSY:          "server busy",
+	SHUTDOWN:      "shutting down",
+	DISCONNECT:    "disconnected by admin",
+	RECONNECT:     "reconnect requested",
+	FAILBACK:      "failing back to preferred server",
+	DISABLED:      "client disabled",
+	OUTSIDE_HOURS: "outside allowed hours",
+	PROFILE:       "profile changed",
 }
 
-func CloseConn(conn *quic.Conn, reason CLOSE_REASON) error {
-	reason_s, ok := REASON_STRING[reason]
-	if !ok {
-		reason_s = "undefined"
+func (v CLOSE_REASON) String() string {
+	if reason, ok := REASON_STRING[v]; ok {
+		return reason
 	}
+	return "undefined"
+}
+
+// Shutdown is the cause of a session ended on purpose (see context.WithCancelCause), the peer is told the reason
+type Shutdown struct {
+	Reason CLOSE_REASON
+}
+
+func (v *Shutdown) Error() string {
+	return v.Reason.String()
+}
+
+func NewShutdown(reason CLOSE_REASON) error {
+	return &Shutdown{Reason: reason}
+}
+
+// ShutdownReason returns the reason carried by a Shutdown cause, SHUTDOWN for any other cause
+func ShutdownReason(cause error) CLOSE_REASON {
+	var shutdown *Shutdown
+	if errors.As(cause, &shutdown) {
+		return shutdown.Reason
+	}
+	return SHUTDOWN
+}
+
+// Returned when the connection was only a probe checking the server is up
+var ErrProbe = errors.New("probe")
+
+// IsRejected tells whether err comes from the server turning the client away because it is busy
+func IsRejected(err error) bool {
+	return is_close_reason(err, BUSY)
+}
+
+// is_close_reason tells whether err is the peer closing the connection with reason
+func is_close_reason(err error, reason CLOSE_REASON) bool {
+	var application_error *quic.ApplicationError
+	return errors.As(err, &application_error) && application_error.Remote && application_error.ErrorCode == quic.ApplicationErrorCode(reason)
+}
+
+func CloseConn(conn *quic.Conn, reason CLOSE_REASON) error {
 	if conn != nil {
-		return conn.CloseWithError(quic.ApplicationErrorCode(int(reason)), reason_s)
+		return conn.CloseWithError(quic.ApplicationErrorCode(int(reason)), reason.String())
 	} else {
 		return nil
 	}
 }
+
+// peer_name is the common name of the certificate the peer presented
+func peer_name(conn *quic.Conn) string {
+	certs := conn.ConnectionState().TLS.PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
+
+// peer_identities lists the common name and the subject alternative names (DNS, email, URI, IP) of the peer certificate
+func peer_identities(conn *quic.Conn) []string {
+	certs := conn.ConnectionState().TLS.PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	cert := certs[0]
+	result := []string{cert.Subject.CommonName}
+	result = append(result, cert.DNSNames...)
+	result = append(result, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		result = append(result, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		result = append(result, ip.String())
+	}
+	return result
+}
+
 func (v QuicConfig) GenerateTLSConfig(server_addr string, is_server bool) *tls.Config {
 	key_bytes, err := os.ReadFile(v.KeyFile)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(v.logger(), "Unable to read key", "file", v.KeyFile, "error", err)
 	}
 
 	cert_bytes, err := os.ReadFile(v.CertFile)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(v.logger(), "Unable to read certificate", "file", v.CertFile, "error", err)
 	}
 
 	ca_bytes, err := os.ReadFile(v.CAFile)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(v.logger(), "Unable to read CA", "file", v.CAFile, "error", err)
 	}
 
 	tlsCert, err := tls.X509KeyPair(cert_bytes, key_bytes)
@@ -102,15 +212,18 @@ func (v QuicConfig) GenerateTLSConfig(server_addr string, is_server bool) *tls.C
 	}
 }
 
+// ReadCommand reads one command, of any size WrapCommand accepts
 func ReadCommand(r io.Reader) (message.Command, error) {
-	buffer := make([]byte, 4096)
-	nread, err := io.ReadFull(r, buffer[:3])
+	header := make([]byte, 3)
+	nread, err := io.ReadFull(r, header)
 	if err != nil {
 		return message.Command{}, err
 	}
 
-	size := int(buffer[1])*256 + int(buffer[2])
-	nread2, err := io.ReadFull(r, buffer[3:3+size])
+	size := int(header[1])*256 + int(header[2])
+	buffer := make([]byte, 3+size)
+	copy(buffer, header)
+	nread2, err := io.ReadFull(r, buffer[3:])
 	if err != nil {
 		return message.Command{}, err
 	}
@@ -122,6 +235,16 @@ func get_stats[T any](p *pool.Pool[T]) string {
 	return fmt.Sprintf("Borrowed: %d Created: %d Returned: %d Destroyed: %d Tested: %d",
 		p.BorrowedCount(), p.CreatedCount(), p.ReturnedCount(), p.DestroyedCount(), p.TestedCount())
 }
+
+func get_pool_stats[T any](p *pool.Pool[T]) PoolStats {
+	return PoolStats{
+		Borrowed:  p.BorrowedCount(),
+		Created:   p.CreatedCount(),
+		Returned:  p.ReturnedCount(),
+		Destroyed: p.DestroyedCount(),
+		Tested:    p.TestedCount(),
+	}
+}
 func WriteCommand(w io.Writer, command message.Command) (int, error) {
 	nwritten, err := w.Write([]byte{
 		byte(command.Type),
@@ -138,8 +261,9 @@ func WriteCommand(w io.Writer, command message.Command) (int, error) {
 
 func DefaultConfig() *quic.Config {
 	return &quic.Config{
-		KeepAlivePeriod: 3 * time.Second,
-		MaxIdleTimeout:  10 * time.Second,
+		KeepAlivePeriod:    3 * time.Second,
+		MaxIdleTimeout:     10 * time.Second,
+		MaxIncomingStreams: MAX_STREAMS + 1 + FORWARD_STREAMS,
 	}
 }
 
@@ -149,6 +273,9 @@ func decodePacket(str *quic.Stream, buffer []byte) (int, error) {
 		return nread, err
 	}
 	size := int(buffer[0])*256 + int(buffer[1])
+	if size+2 > len(buffer) {
+		return nread, fmt.Errorf("frame of %d bytes exceeds buffer of %d bytes", size, len(buffer))
+	}
 	dataread, err := io.ReadFull(str, buffer[2:size+2])
 	nread += dataread
 	if err != nil {
@@ -157,6 +284,49 @@ func decodePacket(str *quic.Stream, buffer []byte) (int, error) {
 	return nread, nil
 }
 
+// WriteStreamCount tells the server how many data streams the client is going to open
+func WriteStreamCount(writer io.Writer, count int) error {
+	_, err := writer.Write([]byte{byte(count / 256), byte(count % 256)})
+	return err
+}
+
+func ReadStreamCount(reader io.Reader) (int, error) {
+	buffer := make([]byte, 2)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return 0, err
+	}
+	count := int(buffer[0])*256 + int(buffer[1])
+	if count < 1 || count > MAX_STREAMS {
+		return 0, fmt.Errorf("invalid stream count %d", count)
+	}
+	return count, nil
+}
+
+// qWrite writes the packet to a stream chosen by the hash of its 5-tuple, so packets of
+// one flow stay in order while different flows use the streams in parallel. locks has one mutex per stream,
+// the length and the packet of concurrent writers must not interleave. streams are only used once ready
+// is closed by runReaders, until then qWrite waits. Fails with ErrClosed when conn is done first
+func qWrite(conn *quic.Conn, streams []*quic.Stream, locks []sync.Mutex, ready <-chan struct{}, buffer []byte) (int, error) {
+	size := len(buffer)
+	if size > MAX_PAYLOAD {
+		return 0, ErrTooLarge
+	}
+	select {
+	case <-ready:
+	case <-conn.Context().Done():
+		return 0, ErrClosed
+	}
+	var selected = int(packet.FlowHash(buffer) % uint32(len(streams)))
+	var stream = streams[selected]
+	locks[selected].Lock()
+	defer locks[selected].Unlock()
+	_, err := stream.Write([]byte{byte(size / 256), byte(size % 256)})
+	if err != nil {
+		return 0, err
+	}
+	return stream.Write(buffer)
+}
+
 func Ping(writer io.Writer) error {
 	_, err := writer.Write([]byte{0})
 	return err
@@ -167,21 +337,32 @@ func Pong(reader io.Reader) error {
 	_, err := io.ReadFull(reader, buffer)
 	return err
 }
-func runReaders(pool *pool.Pool[[]byte], conn *quic.Conn, mystreams []*quic.Stream, ch chan Buffer, accept bool) error {
-	log.Printf("Starting %d reader streams...\n", len(mystreams))
+
+// runReaders reads the data streams, taken from accepted or opened when accepted is nil. ready is closed once
+// mystreams are all set. The connection is closed when they aren't within HANDSHAKE_TIMEOUT
+func runReaders(pool *pool.Pool[[]byte], conn *quic.Conn, mystreams []*quic.Stream, ready chan<- struct{}, ch chan Buffer, accepted <-chan *quic.Stream, logger *slog.Logger) error {
+	logger.Debug("Starting reader streams", "streams", len(mystreams))
 	defer func() {
-		log.Printf("Stopped %d reader streams.\n", len(mystreams))
+		logger.Debug("Stopped reader streams", "streams", len(mystreams))
 	}()
+	defer close(ch)
+	ctx, cancel := context.WithTimeout(conn.Context(), HANDSHAKE_TIMEOUT)
+	defer cancel()
 	for i := 0; i < len(mystreams); i++ {
 		var str *quic.Stream
 		var err error
-		if accept {
-			str, err = conn.AcceptStream(context.Background())
-			if err == nil {
-				Pong(str)
+		if accepted != nil {
+			select {
+			case next, ok := <-accepted:
+				if !ok {
+					err = ErrClosed
+				}
+				str = next
+			case <-ctx.Done():
+				err = ctx.Err()
 			}
 		} else {
-			str, err = conn.OpenStreamSync(context.Background())
+			str, err = conn.OpenStreamSync(ctx)
 			if err == nil {
 				Ping(str)
 			}
@@ -190,10 +371,13 @@ func runReaders(pool *pool.Pool[[]byte], conn *quic.Conn, mystreams []*quic.Stre
 			for j := 0; j < i; j++ {
 				mystreams[j].Close()
 			}
+			logger.Warn("Data streams not set up", "streams", len(mystreams), "ready", i, "error", err)
+			CloseConn(conn, CLOSE)
 			return err
 		}
 		mystreams[i] = str
 	}
+	close(ready)
 	wg := new(sync.WaitGroup)
 	for i := 0; i < len(mystreams); i++ {
 		var id int = i
@@ -202,12 +386,14 @@ func runReaders(pool *pool.Pool[[]byte], conn *quic.Conn, mystreams []*quic.Stre
 		go func() {
 			defer wg.Done()
 			for {
+				// never fails, the pool makes a buffer when it is empty
 				buffer, _ := pool.Borrow()
 				count, err := decodePacket(thestream, buffer)
 				if err != nil {
 					// connection broken
 					return
 				}
+				// blocks while the TUN writer is behind, QUIC flow control slows the peer down
 				ch <- WrapBuffer(buffer, 2, count)
 			}
 		}()
@@ -218,7 +404,6 @@ func runReaders(pool *pool.Pool[[]byte], conn *quic.Conn, mystreams []*quic.Stre
 			str.Close()
 		}
 	}
-	close(ch)
 	return nil
 }
 
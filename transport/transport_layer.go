@@ -1,16 +1,72 @@
 package transport
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/wushilin/go-vpn/message"
 )
 
+// Returned by Write when the packet is larger than MaxPayload. The transport is still usable
+var ErrTooLarge = errors.New("packet exceeds transport payload")
+
+// Steps of the connection setup, used as HandshakeError reasons
+const REASON_CONNECT = "connect"
+const REASON_CERTIFICATE = "certificate"
+const REASON_CONTROL = "control"
+const REASON_STREAMS = "streams"
+const REASON_REJECTED = "rejected"
+const REASON_PROFILE = "profile"
+
+// HandshakeError tells at which step setting up a session failed
+type HandshakeError struct {
+	Reason string
+	Err    error
+}
+
+func (v *HandshakeError) Error() string {
+	return fmt.Sprintf("%s: %s", v.Reason, v.Err)
+}
+
+func (v *HandshakeError) Unwrap() error {
+	return v.Err
+}
+
+func NewHandshakeError(reason string, err error) error {
+	return &HandshakeError{Reason: reason, Err: err}
+}
+
+// Usage of the pooled packet buffers
+type PoolStats struct {
+	Borrowed  int64
+	Created   int64
+	Returned  int64
+	Destroyed int64
+	Tested    int64
+}
+
 type Transport interface {
 	io.ReadWriteCloser
 	ReadControlCommand() (message.Command, error)
 	WriteControlCommand(command message.Command) (int, error)
 	GetStats() string
+	GetPoolStats() PoolStats
+	// Largest packet Write accepts, the frame buffer size. Unrelated to the path MTU
+	MaxPayload() int
+	// Identity (certificate common name) of the peer
+	PeerName() string
+	// Common name and subject alternative names of the peer certificate
+	PeerIdentities() []string
+	// Network address of the peer
+	RemoteAddr() string
+	// CloseWithReason closes the connection, the peer sees reason as application error code. Close uses CLOSE
+	CloseWithReason(reason CLOSE_REASON) error
+	// OpenForward opens a stream to the peer carrying one forwarded connection
+	OpenForward(ctx context.Context) (Stream, error)
+	// AcceptForward waits for a stream the peer opened with OpenForward. Fails with ErrClosed once the connection is gone
+	AcceptForward(ctx context.Context) (Stream, error)
 }
 
 type Buffer struct {